@@ -27,6 +27,9 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 
@@ -112,68 +115,204 @@ func (v *VespaMgr) BasicVespaConf() VESAgentConfiguration {
 //    }
 // }
 func (v *VespaMgr) ParseMetricsFromDescriptor(descriptor []byte, appMetrics AppMetrics) AppMetrics {
-	var desc []map[string]interface{}
-	json.Unmarshal(descriptor, &desc)
+	v.parseDescriptor(descriptor, appMetrics)
+	return appMetrics
+}
+
+// parseDescriptor adds the valid metrics of the descriptor into appMetrics, and
+// returns the problems found in it
+func (v *VespaMgr) parseDescriptor(descriptor []byte, appMetrics AppMetrics) []ValidationError {
+	configs, errs := ParseXappConfigs(descriptor)
+	for _, config := range configs {
+		for _, m := range config.Config.Measurements {
+			errs = append(errs, v.addMeasurement(config.Metadata, m, appMetrics)...)
+		}
+	}
+	return errs
+}
+
+// Parses the metrics data from an array of interfaces, which are expected to be maps
+// of the following format:
+//    { "name": xxx, "objectName": yyy, "objectInstance": zzz, "counterId": nnn }
+// Entries, which do not have all the necessary fields, are ignored.
+func (v *VespaMgr) ParseMetricsRules(metricsMap []interface{}, appMetrics AppMetrics, moId, measType, measId, measInterval string) AppMetrics {
+	m := Measurement{MoId: moId, MeasType: measType, MeasId: measId, MeasInterval: measInterval}
+	for i, element := range metricsMap {
+		raw, _ := json.Marshal(element)
+		if metric, errs := decodeMetric(raw, fmt.Sprintf("#%d", i), "", measId); !hasErrors(errs) {
+			m.Metrics = append(m.Metrics, metric)
+		}
+	}
+	v.addMeasurement(XappMetadata{}, m, appMetrics)
+	return appMetrics
+}
+
+// metricKey identifies a metric in AppMetrics. Metrics of xApps are scoped by the
+// xApp instance, so that different xApps, and instances of the same xApp in
+// different namespaces, can use the same counter names.
+func metricKey(xappInstance, name string) string {
+	if xappInstance == "" {
+		return name
+	}
+	return xappInstance + "/" + name
+}
 
-	for _, appl := range desc {
-		config, configOk := appl["config"]
-		if !configOk {
-			app.Logger.Info("No xApp config found!")
+// addMeasurement adds the metrics of a validated measurement into appMetrics.
+// Metrics already defined, and metrics mapping to the same VES object as a metric
+// defined earlier, are skipped and reported.
+func (v *VespaMgr) addMeasurement(meta XappMetadata, m Measurement, appMetrics AppMetrics) []ValidationError {
+	xappName := meta.XappName
+	app.Logger.Info("Parsed measurement: moId=%s type=%s id=%s interval=%s", m.MoId, m.MeasType, m.MeasId, m.MeasInterval)
+
+	var errs []ValidationError
+	for _, metric := range m.Metrics {
+		key := metricKey(meta.Instance(), metric.Name)
+		if _, alreadyFound := appMetrics[key]; alreadyFound {
+			app.Logger.Info("skipped duplicate counter %s", key)
+			errs = append(errs, ValidationError{Severity: severityError, XApp: xappName, Measurement: m.MeasId, Metric: metric.Name, Reason: reasonDuplicate})
 			continue
 		}
-		measurements, measurementsOk := config.(map[string]interface{})["measurements"]
-		if !measurementsOk {
-			app.Logger.Info("No xApp metrics found!")
+
+		value := AppMetricsStruct{
+			XApp:           xappName,
+			Namespace:      meta.Namespace,
+			Name:           metric.Name,
+			MoId:           m.MoId,
+			MeasType:       m.MeasType,
+			MeasId:         m.MeasId,
+			MeasInterval:   m.MeasInterval,
+			ObjectName:     metric.ObjectName,
+			ObjectInstance: metric.ObjectInstance,
+			CounterId:      metric.CounterId,
+			Type:           metric.Type,
+			Unit:           metric.Unit,
+			Description:    metric.Description,
+		}
+		if other, found := findConflict(appMetrics, value); found {
+			app.Logger.Info("skipped conflicting counter %s, clashes with %s", key, other)
+			errs = append(errs, ValidationError{Severity: severityError, XApp: xappName, Measurement: m.MeasId, Metric: metric.Name,
+				Reason: fmt.Sprintf("%s with %s", reasonConflict, other)})
 			continue
 		}
 
-		for _, m := range measurements.([]interface{}) {
-			moId, moIdOk := m.(map[string]interface{})["moId"].(string)
-			measType, measTypeOk := m.(map[string]interface{})["measType"].(string)
-			measId, measIdOk := m.(map[string]interface{})["measId"].(string)
-			measInterval, measIntervalOk := m.(map[string]interface{})["measInterval"].(string)
-			metrics, metricsOk := m.(map[string]interface{})["metrics"]
-			if !metricsOk || !measTypeOk || !measIdOk || !moIdOk || !measIntervalOk {
-				app.Logger.Info("No metrics found for moId=%s measType=%s measId=%s measInterval=%s", moId, measId, measType, measInterval)
-				continue
-			}
-			app.Logger.Info("Parsed measurement: moId=%s type=%s id=%s interval=%s", moId, measType, measId, measInterval)
+		appMetrics[key] = value
+		app.Logger.Info("Parsed counter name=%s %s/%s  M%sC%s", key, metric.ObjectName, metric.ObjectInstance, m.MeasId, metric.CounterId)
+	}
+	return errs
+}
 
-			v.ParseMetricsRules(metrics.([]interface{}), appMetrics, moId, measType, measId, measInterval)
+// findConflict looks for a metric which is reported as the same VES object. The
+// metrics of other instances of the same xApp are told apart by their namespace.
+func findConflict(appMetrics AppMetrics, value AppMetricsStruct) (string, bool) {
+	for _, key := range sortedMetricNames(appMetrics) {
+		other := appMetrics[key]
+		if other.XApp == value.XApp && other.Namespace != value.Namespace {
+			continue
+		}
+		if other.MoId == value.MoId && other.MeasId == value.MeasId &&
+			other.ObjectInstance == value.ObjectInstance && other.CounterId == value.CounterId {
+			return key, true
 		}
 	}
-	return appMetrics
+	return "", false
 }
 
-// Parses the metrics data from an array of interfaces, which are expected to be maps
-// of the following format:
-//    { "name": xxx, "objectName": yyy, "objectInstance": zzz }
-// Entries, which do not have all the necessary fields, are ignored.
-func (v *VespaMgr) ParseMetricsRules(metricsMap []interface{}, appMetrics AppMetrics, moId, measType, measId, measInterval string) AppMetrics {
-	for _, element := range metricsMap {
-		name, nameOk := element.(map[string]interface{})["name"].(string)
-		if nameOk {
-			_, alreadyFound := appMetrics[name]
-			objectName, objectNameOk := element.(map[string]interface{})["objectName"].(string)
-			objectInstance, objectInstanceOk := element.(map[string]interface{})["objectInstance"].(string)
-			counterId, counterIdOk := element.(map[string]interface{})["counterId"].(string)
-			if !alreadyFound && objectNameOk && objectInstanceOk && counterIdOk {
-				appMetrics[name] = AppMetricsStruct{moId, measType, measId, measInterval, objectName, objectInstance, counterId}
-				app.Logger.Info("Parsed counter name=%s %s/%s  M%sC%s", name, objectName, objectInstance, measId, counterId)
-			}
-			if alreadyFound {
-				app.Logger.Info("skipped duplicate counter %s", name)
-			}
+// MetricSelector restricts the Prometheus queries of xApp metrics to the series of
+// the owning xApp instance. In XApp, %s is replaced with the xApp name quoted as a
+// regular expression, in Namespace with the namespace of the xApp.
+type MetricSelector struct {
+	XApp      string
+	Namespace string
+}
+
+// configuredSelector returns the metric selector of the vespamgr configuration
+func configuredSelector() MetricSelector {
+	return MetricSelector{
+		XApp:      app.Config.GetString("controls.vesagent.xappSelector"),
+		Namespace: app.Config.GetString("controls.vesagent.namespaceSelector"),
+	}
+}
+
+// metricExpr returns the Prometheus query of the metric. Queries of xApp metrics
+// are restricted with label selectors to the series of the owning xApp instance.
+func metricExpr(value AppMetricsStruct, selector MetricSelector) string {
+	var selectors []string
+	if value.XApp != "" && selector.XApp != "" {
+		// The name is a regular expression literal inside a PromQL string
+		name := strings.Replace(regexp.QuoteMeta(value.XApp), `\`, `\\`, -1)
+		selectors = append(selectors, strings.Replace(selector.XApp, "%s", name, -1))
+	}
+	if value.XApp != "" && value.Namespace != "" && selector.Namespace != "" {
+		selectors = append(selectors, strings.Replace(selector.Namespace, "%s", value.Namespace, -1))
+	}
+	if len(selectors) == 0 {
+		return value.Name
+	}
+
+	joined := strings.Join(selectors, ",")
+	if strings.HasSuffix(value.Name, "}") {
+		if strings.HasSuffix(value.Name, "{}") {
+			return strings.TrimSuffix(value.Name, "}") + joined + "}"
 		}
+		return strings.TrimSuffix(value.Name, "}") + "," + joined + "}"
 	}
-	return appMetrics
+	return value.Name + "{" + joined + "}"
+}
+
+// descriptorSource is a measurement descriptor, and where it was read from
+type descriptorSource struct {
+	name       string
+	descriptor []byte
+}
+
+// GetRules sets the metric rules of the xApp and platform measurements in the
+// configuration. It returns the source of each rule, and the problems found in the
+// descriptors.
+func (v *VespaMgr) GetRules(vespaconf *VESAgentConfiguration, xAppConfig []byte, pltSources []descriptorSource, selector MetricSelector) ([]RuleSource, []ValidationError) {
+	sources := append([]descriptorSource{{name: "appmgr", descriptor: xAppConfig}}, pltSources...)
+	rules, ruleSources, errs := v.buildRules(sources, selector)
+
+	vespaconf.Measurement.Prometheus.Rules.Metrics = rules
+	if len(vespaconf.Measurement.Prometheus.Rules.Metrics) == 0 {
+		app.Logger.Info("vespa config with empty metrics")
+	}
+	return ruleSources, errs
+}
+
+// platformSources returns the platform measurement descriptors: the ones posted to
+// the measurement URL, and the platform counters. confMu must be held.
+func (v *VespaMgr) platformSources() []descriptorSource {
+	var sources []descriptorSource
+	if v.pltFileCreated {
+		store, err := readPltStore(app.Config.GetString("controls.pltFile"))
+		if err != nil {
+			app.Logger.Error("Unable to read platform config file: %v", err)
+		}
+		for _, component := range sortedComponents(store) {
+			sources = append(sources, descriptorSource{name: "pltFile/" + component, descriptor: store[component]})
+		}
+	}
+
+	// Adding Platform Counters
+	pltCounterFile := app.Config.GetString("controls.pltCounterFile")
+	pltCounters, err := ioutil.ReadFile(pltCounterFile)
+	if err != nil {
+		app.Logger.Error("Platform Matrices Configuration File not found")
+	} else {
+		sources = append(sources, descriptorSource{name: "pltCounterFile", descriptor: pltCounters})
+	}
+	return sources
 }
 
-func (v *VespaMgr) GetRules(vespaconf *VESAgentConfiguration, xAppConfig []byte) bool {
-	makeRule := func(expr string, value AppMetricsStruct) MetricRule {
-		return MetricRule{
+// buildRules creates the metric rules of the descriptors, and tells the source of
+// each rule. A metric defined in more than one descriptor is taken from the first
+// one. The queries of xApp metrics are restricted with selector. Nothing is
+// stored, so that the rules can also be previewed.
+func (v *VespaMgr) buildRules(sources []descriptorSource, selector MetricSelector) ([]MetricRule, []RuleSource, []ValidationError) {
+	makeRule := func(value AppMetricsStruct) MetricRule {
+		rule := MetricRule{
 			Target:         "AdditionalObjects",
-			Expr:           expr,
+			Expr:           metricExpr(value, selector),
 			ObjectInstance: fmt.Sprintf("%s:%s", value.ObjectInstance, value.CounterId),
 			ObjectName:     value.ObjectName,
 			ObjectKeys: []Label{
@@ -184,64 +323,217 @@ func (v *VespaMgr) GetRules(vespaconf *VESAgentConfiguration, xAppConfig []byte)
 				{Name: "measInterval", Expr: value.MeasInterval},
 			},
 		}
+		if value.XApp != "" && value.Namespace != "" {
+			rule.ObjectKeys = append(rule.ObjectKeys, Label{Name: "namespace", Expr: value.Namespace})
+		}
+		if value.Type != "" {
+			rule.ObjectKeys = append(rule.ObjectKeys, Label{Name: "counterType", Expr: value.Type})
+		}
+		if value.Unit != "" {
+			rule.ObjectKeys = append(rule.ObjectKeys, Label{Name: "unit", Expr: value.Unit})
+		}
+		return rule
 	}
-	appMetrics := make(AppMetrics)
-	metrics := v.ParseMetricsFromDescriptor(xAppConfig, appMetrics)
 
-	if v.pltFileCreated {
-		pltConfig, err := ioutil.ReadFile(app.Config.GetString("controls.pltFile"))
-		if err != nil {
-			app.Logger.Error("Unable to read platform config file: %v", err)
-		} else {
-			metrics = v.ParseMetricsFromDescriptor(pltConfig, metrics)
+	metrics := make(AppMetrics)
+	var errs []ValidationError
+	for _, source := range sources {
+		for _, e := range v.parseDescriptor(source.descriptor, metrics) {
+			e.Source = source.name
+			app.Logger.Warn("Measurement descriptor rejected: %s", e.Error())
+			errs = append(errs, e)
+		}
+		for key, value := range metrics {
+			if value.Source == "" {
+				value.Source = source.name
+				metrics[key] = value
+			}
 		}
 	}
-    
-	// Adding Platform Counters
-	pltCounterFile :=  app.Config.GetString("controls.pltCounterFile")
-	bytes, err := ioutil.ReadFile(pltCounterFile)
-	if err != nil{
-		app.Logger.Error("Platform Matrices Configuration File not found")
-	} else {
 
-		metrics = v.ParseMetricsFromDescriptor(bytes,metrics)
+	rules := make([]MetricRule, 0, len(metrics))
+	ruleSources := make([]RuleSource, 0, len(metrics))
+	for _, key := range sortedMetricNames(metrics) {
+		rule := makeRule(metrics[key])
+		rules = append(rules, rule)
+		ruleSources = append(ruleSources, RuleSource{Source: metrics[key].Source, XApp: metrics[key].XApp, Name: metrics[key].Name,
+			Expr: rule.Expr, ObjectName: rule.ObjectName, ObjectInstance: rule.ObjectInstance})
 	}
-	
+	return rules, ruleSources, errs
+}
 
-	vespaconf.Measurement.Prometheus.Rules.Metrics = make([]MetricRule, 0, len(metrics))
-	for key, value := range metrics {
-		vespaconf.Measurement.Prometheus.Rules.Metrics = append(vespaconf.Measurement.Prometheus.Rules.Metrics, makeRule(key, value))
-	}
-	if len(vespaconf.Measurement.Prometheus.Rules.Metrics) == 0 {
-		app.Logger.Info("vespa config with empty metrics")
+// sortedMetricNames returns the metric names ordered by moId, measId, counterId
+// and name, so that the generated rules are always in the same order
+func sortedMetricNames(metrics AppMetrics) []string {
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
 	}
-
-	return len(vespaconf.Measurement.Prometheus.Rules.Metrics) > 0
+	sort.Slice(names, func(i, j int) bool {
+		a, b := metrics[names[i]], metrics[names[j]]
+		if a.MoId != b.MoId {
+			return a.MoId < b.MoId
+		}
+		if a.MeasId != b.MeasId {
+			return a.MeasId < b.MeasId
+		}
+		if a.CounterId != b.CounterId {
+			return a.CounterId < b.CounterId
+		}
+		return names[i] < names[j]
+	})
+	return names
 }
 
 func (v *VespaMgr) GetCollectorConfiguration(vespaconf *VESAgentConfiguration) {
-	vespaconf.PrimaryCollector.User = app.Config.GetString("controls.collector.primaryUser")
-	vespaconf.PrimaryCollector.Password = app.Config.GetString("controls.collector.primaryPassword")
-	vespaconf.PrimaryCollector.PassPhrase = ""
+	vespaconf.PrimaryCollector.User = getCredential("controls.collector.primaryUser")
+	vespaconf.PrimaryCollector.Password = getCredential("controls.collector.primaryPassword")
+	vespaconf.PrimaryCollector.PassPhrase = getCredential("controls.collector.primaryPassPhrase")
 	vespaconf.PrimaryCollector.FQDN = app.Config.GetString("controls.collector.primaryAddr")
 	vespaconf.PrimaryCollector.ServerRoot = app.Config.GetString("controls.collector.serverRoot")
 	vespaconf.PrimaryCollector.Topic = ""
 	vespaconf.PrimaryCollector.Port = app.Config.GetInt("controls.collector.primaryPort")
 	vespaconf.PrimaryCollector.Secure = app.Config.GetBool("controls.collector.secure")
+
+	// The secondary collector, which the VES agent calls the backup collector, uses
+	// the settings of the primary one, unless given separately
+	if secondaryAddr := app.Config.GetString("controls.collector.secondaryAddr"); secondaryAddr != "" {
+		vespaconf.BackupCollector = vespaconf.PrimaryCollector
+		vespaconf.BackupCollector.FQDN = secondaryAddr
+		if port := app.Config.GetInt("controls.collector.secondaryPort"); port != 0 {
+			vespaconf.BackupCollector.Port = port
+		}
+		if serverRoot := app.Config.GetString("controls.collector.secondaryServerRoot"); serverRoot != "" {
+			vespaconf.BackupCollector.ServerRoot = serverRoot
+		}
+		if secure := app.Config.GetString("controls.collector.secondarySecure"); secure != "" {
+			vespaconf.BackupCollector.Secure = secure == "true"
+		}
+		if user := getCredential("controls.collector.secondaryUser"); user != "" {
+			vespaconf.BackupCollector.User = user
+			vespaconf.BackupCollector.Password = getCredential("controls.collector.secondaryPassword")
+			vespaconf.BackupCollector.PassPhrase = getCredential("controls.collector.secondaryPassPhrase")
+		}
+	}
+
+	collectorTLS := v.getCollectorTLS()
+	vespaconf.CaCert = collectorTLS.CaCert
 }
 
-func (v *VespaMgr) CreateConfig(writer io.Writer, xAppStatus []byte) {
+// getCredential returns a collector credential. The credential is read from the
+// file given by the "<key>File" setting, e.g. a mounted Kubernetes secret, if set.
+// Otherwise the setting itself holds the credential, or names the environment
+// variable holding it as "env:NAME".
+func getCredential(key string) string {
+	value, err := resolveCredential(app.Config.GetString(key), app.Config.GetString(key+"File"))
+	if err != nil {
+		app.Logger.Error("Unable to resolve %s: %v", key, err)
+	}
+	return value
+}
 
-	
+func resolveCredential(value, fname string) (string, error) {
+	if fname != "" {
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	if strings.HasPrefix(value, "env:") {
+		name := strings.TrimPrefix(value, "env:")
+		envValue, found := os.LookupEnv(name)
+		if !found {
+			return "", fmt.Errorf("environment variable %s not set", name)
+		}
+		return envValue, nil
+	}
+	return value, nil
+}
+
+// BuildConfig creates the VES agent configuration for the given xApp configurations
+// and platform measurement descriptors, restricting the queries of xApp metrics with
+// selector. The source of each metric rule, and the problems found in the
+// descriptors, are returned for storing with the configuration once it is written.
+func (v *VespaMgr) BuildConfig(xAppStatus []byte, pltSources []descriptorSource, selector MetricSelector) (VESAgentConfiguration, []RuleSource, []ValidationError) {
 	vespaconf := v.BasicVespaConf()
-	v.GetRules(&vespaconf, xAppStatus)
+	sources, errs := v.GetRules(&vespaconf, xAppStatus, pltSources, selector)
 	v.GetCollectorConfiguration(&vespaconf)
-    
-	err := yaml.NewEncoder(writer).Encode(vespaconf)
+	return vespaconf, sources, errs
+}
+
+// buildCurrentConfig creates the VES agent configuration for the given xApp
+// configurations with the platform measurements and the settings in use
+func (v *VespaMgr) buildCurrentConfig(xAppStatus []byte) (VESAgentConfiguration, []RuleSource, []ValidationError) {
+	return v.BuildConfig(xAppStatus, v.platformSources(), configuredSelector())
+}
+
+func (v *VespaMgr) CreateConfig(writer io.Writer, xAppStatus []byte) {
+	vespaconf, _, _ := v.buildCurrentConfig(xAppStatus)
+
+	data, err := encodeConfig(&vespaconf)
 	if err != nil {
+		app.Logger.Error("Cannot encode vespa conf: %s", err.Error())
+		return
+	}
+	if _, err := writer.Write(data); err != nil {
 		app.Logger.Error("Cannot write vespa conf file: %s", err.Error())
 		return
 	}
 	app.Logger.Info("Config file written to: %s", app.Config.GetString("controls.vesagent.configFile"))
 }
 
+// encodeConfig encodes the VES agent configuration as the YAML read by the agent
+func encodeConfig(vespaconf *VESAgentConfiguration) ([]byte, error) {
+	return yaml.Marshal(vespaconf)
+}
+
+// ruleKey identifies a metric rule by its Prometheus expression and the VES object
+// it is reported as
+func ruleKey(rule MetricRule) string {
+	return fmt.Sprintf("%s %s/%s", rule.Expr, rule.ObjectName, rule.ObjectInstance)
+}
+
+// DiffConfig compares two VES agent configurations and describes the differences.
+// Metric rules are matched by their Prometheus expression and VES object, so the
+// order of the rules does not matter. An empty result means that the configurations
+// are equal.
+func DiffConfig(oldConf, newConf *VESAgentConfiguration) []string {
+	var diff []string
+
+	oldRules := make(map[string][]MetricRule)
+	for _, rule := range oldConf.Measurement.Prometheus.Rules.Metrics {
+		oldRules[ruleKey(rule)] = append(oldRules[ruleKey(rule)], rule)
+	}
+	newRules := make(map[string][]MetricRule)
+	for _, rule := range newConf.Measurement.Prometheus.Rules.Metrics {
+		newRules[ruleKey(rule)] = append(newRules[ruleKey(rule)], rule)
+	}
+	for key, rules := range newRules {
+		if oldRule, found := oldRules[key]; !found {
+			diff = append(diff, "added rule "+key)
+		} else if !reflect.DeepEqual(oldRule, rules) {
+			diff = append(diff, "changed rule "+key)
+		}
+	}
+	for key := range oldRules {
+		if _, found := newRules[key]; !found {
+			diff = append(diff, "removed rule "+key)
+		}
+	}
+	sort.Strings(diff)
+
+	// Compare the rest of the configuration section by section
+	oldCopy, newCopy := *oldConf, *newConf
+	oldCopy.Measurement.Prometheus.Rules.Metrics = nil
+	newCopy.Measurement.Prometheus.Rules.Metrics = nil
+	oldValue, newValue := reflect.ValueOf(oldCopy), reflect.ValueOf(newCopy)
+	for i := 0; i < oldValue.NumField(); i++ {
+		if !reflect.DeepEqual(oldValue.Field(i).Interface(), newValue.Field(i).Interface()) {
+			name := strings.Split(oldValue.Type().Field(i).Tag.Get("yaml"), ",")[0]
+			diff = append(diff, "changed "+name)
+		}
+	}
+	return diff
+}
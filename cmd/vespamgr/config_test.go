@@ -22,7 +22,10 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -229,4 +232,308 @@ func TestParsePlatformConfigWithNoMetrices(t *testing.T) {
 	appMetrics := make(AppMetrics)
 	appMetrics = vespaMgr.ParseMetricsFromDescriptor(metricsBytes, appMetrics)
 	assert.Empty(t, appMetrics)
-}
\ No newline at end of file
+}
+
+func TestDiffConfigIgnoresRuleOrder(t *testing.T) {
+	bytes, err := ioutil.ReadFile("../../test/xApp_config_test_output.json")
+	assert.Nil(t, err)
+	vespaMgr := NewVespaMgr()
+	oldConf, _, _ := vespaMgr.buildCurrentConfig(bytes)
+	newConf, _, _ := vespaMgr.buildCurrentConfig(bytes)
+
+	rules := newConf.Measurement.Prometheus.Rules.Metrics
+	rules[0], rules[len(rules)-1] = rules[len(rules)-1], rules[0]
+	assert.Empty(t, DiffConfig(&oldConf, &newConf))
+
+	newConf.PrimaryCollector.FQDN = "collector.example.com"
+	newConf.Measurement.Prometheus.Rules.Metrics = rules[1:]
+	newConf.Measurement.Prometheus.Rules.Metrics[0].ObjectKeys = []Label{{Name: "moId", Expr: "changed"}}
+	diff := DiffConfig(&oldConf, &newConf)
+	assert.Len(t, diff, 3)
+	assert.Contains(t, diff, "changed primaryCollector")
+	assert.Contains(t, diff, "removed rule "+ruleKey(rules[0]))
+	assert.Contains(t, diff, "changed rule "+ruleKey(rules[1]))
+}
+
+func TestDiffConfigRulesWithSameExpr(t *testing.T) {
+	rule := MetricRule{Target: "AdditionalObjects", Expr: "c1", ObjectName: "obj", ObjectInstance: "inst:1"}
+	other := rule
+	other.ObjectInstance = "inst:2"
+
+	var oldConf, newConf VESAgentConfiguration
+	oldConf.Measurement.Prometheus.Rules.Metrics = []MetricRule{rule, other}
+	newConf.Measurement.Prometheus.Rules.Metrics = []MetricRule{other, rule}
+	assert.Empty(t, DiffConfig(&oldConf, &newConf))
+
+	changed := other
+	changed.ObjectInstance = "inst:3"
+	newConf.Measurement.Prometheus.Rules.Metrics = []MetricRule{rule, changed}
+	diff := DiffConfig(&oldConf, &newConf)
+	assert.Len(t, diff, 2)
+	assert.Contains(t, diff, "added rule "+ruleKey(changed))
+	assert.Contains(t, diff, "removed rule "+ruleKey(other))
+}
+
+func TestYamlGenerationIsReproducible(t *testing.T) {
+	bytes, err := ioutil.ReadFile("../../config/plt-counter.json")
+	assert.Nil(t, err)
+
+	vespaMgr := NewVespaMgr()
+	first, second := new(strings.Builder), new(strings.Builder)
+	vespaMgr.CreateConfig(first, bytes)
+	for i := 0; i < 5; i++ {
+		second.Reset()
+		vespaMgr.CreateConfig(second, bytes)
+		assert.Equal(t, first.String(), second.String())
+	}
+}
+
+func TestRulesAreSorted(t *testing.T) {
+	appMetrics := AppMetrics{
+		"b": {MoId: "SEP/XAPP", MeasId: "2", CounterId: "0001"},
+		"a": {MoId: "SEP/XAPP", MeasId: "2", CounterId: "0001"},
+		"c": {MoId: "SEP/XAPP", MeasId: "1", CounterId: "0002"},
+		"d": {MoId: "SEP/E2T", MeasId: "9", CounterId: "0009"},
+		"e": {MoId: "SEP/XAPP", MeasId: "1", CounterId: "0001"},
+	}
+	assert.Equal(t, []string{"d", "e", "c", "a", "b"}, sortedMetricNames(appMetrics))
+}
+
+func TestParseDescriptorReportsMalformedShapes(t *testing.T) {
+	descriptor := `[
+		5,
+		{"config": "none"},
+		{"metadata": {"xappName": "app1"}, "config": {"measurements": {"moId": "SEP"}}},
+		{"metadata": {"xappName": "app2"}, "config": {"measurements": [
+			7,
+			{"moId": "SEP", "measType": "X2", "measId": 1, "measInterval": "60", "metrics": []},
+			{"moId": "SEP", "measType": "X2", "measId": "2", "measInterval": "60", "metrics": {}},
+			{"moId": "SEP", "measType": "X2", "measId": "3", "measInterval": "60", "metrics": [
+				3,
+				{"objectName": "o"},
+				{"name": "a", "objectName": "o", "objectInstance": "i"},
+				{"name": "b", "objectName": "o", "objectInstance": "i", "counterId": "0001"},
+				{"name": "b", "objectName": "o", "objectInstance": "i", "counterId": "0002"}
+			]}
+		]}}
+	]`
+	appMetrics := make(AppMetrics)
+	errs := vespaMgr.parseDescriptor([]byte(descriptor), appMetrics)
+
+	assert.Len(t, appMetrics, 1)
+	assert.Equal(t, "0001", appMetrics["app2/b"].CounterId)
+	assert.Equal(t, []ValidationError{
+		{Severity: severityError, Field: "[0]", Reason: reasonNotObject},
+		{Severity: severityError, Field: "config", Reason: reasonNotObject},
+		{Severity: severityError, XApp: "app1", Field: "measurements", Reason: reasonNotArray},
+		{Severity: severityError, XApp: "app2", Measurement: "#0", Reason: reasonNotObject},
+		{Severity: severityError, XApp: "app2", Measurement: "#1", Field: "measId", Reason: reasonNotString},
+		{Severity: severityError, XApp: "app2", Measurement: "2", Field: "metrics", Reason: reasonNotArray},
+		{Severity: severityError, XApp: "app2", Measurement: "3", Metric: "#0", Reason: reasonNotObject},
+		{Severity: severityError, XApp: "app2", Measurement: "3", Metric: "#1", Field: "name", Reason: reasonMissing},
+		{Severity: severityError, XApp: "app2", Measurement: "3", Metric: "#1", Field: "objectInstance", Reason: reasonMissing},
+		{Severity: severityError, XApp: "app2", Measurement: "3", Metric: "#1", Field: "counterId", Reason: reasonMissing},
+		{Severity: severityError, XApp: "app2", Measurement: "3", Metric: "a", Field: "counterId", Reason: reasonMissing},
+		{Severity: severityError, XApp: "app2", Measurement: "3", Metric: "b", Reason: reasonDuplicate},
+	}, errs)
+}
+
+func TestParseDescriptorReportsInvalidJSON(t *testing.T) {
+	errs := vespaMgr.parseDescriptor([]byte(`{"not": "an array"}`), make(AppMetrics))
+	assert.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Reason, reasonInvalidJSON)
+
+	assert.Empty(t, vespaMgr.parseDescriptor([]byte{}, make(AppMetrics)))
+}
+
+func TestValidationReportIsStored(t *testing.T) {
+	bytes, err := ioutil.ReadFile("../../test/inValidMeasurements_xApp_config_test_output.json")
+	assert.Nil(t, err)
+	vespaMgr := NewVespaMgr()
+	fname := fmt.Sprintf("%s/ves-agent-report-%d.yaml", os.TempDir(), os.Getpid())
+	defer os.Remove(fname)
+	assert.True(t, vespaMgr.CreateConf(fname, bytes))
+
+	report := vespaMgr.ValidationReport()
+	assert.False(t, report.Time.IsZero())
+	assert.Len(t, report.Errors, 10)
+	assert.Equal(t, "appmgr", report.Errors[0].Source)
+	assert.Equal(t, "warning: source=appmgr measurement=#0 field=measId_1: unknown field", report.Errors[5].Error())
+	assert.Equal(t, "error: source=appmgr measurement=#0 field=moId: missing", report.Errors[0].Error())
+}
+
+func TestValidationReportIsNotStoredWhenWriteFails(t *testing.T) {
+	bytes, err := ioutil.ReadFile("../../test/inValidMeasurements_xApp_config_test_output.json")
+	assert.Nil(t, err)
+	vespaMgr := NewVespaMgr()
+
+	_, sources, errs := vespaMgr.buildCurrentConfig(bytes)
+	assert.Len(t, errs, 10)
+	assert.NotEmpty(t, sources)
+	assert.True(t, vespaMgr.ValidationReport().Time.IsZero())
+
+	assert.False(t, vespaMgr.CreateConf("/nonexistent/ves-agent.yaml", bytes))
+	assert.True(t, vespaMgr.ValidationReport().Time.IsZero())
+	assert.Nil(t, vespaMgr.ruleSources)
+	assert.Nil(t, vespaMgr.appliedStatus.config)
+}
+
+func TestParseXappConfigsKeepsTypedFields(t *testing.T) {
+	descriptor := `[{"metadata": {"xappName": "app1", "namespace": "ricxapp"}, "config": {"measurements": [
+		{"moId": "SEP", "measType": "X2", "measId": "1", "measInterval": "60", "metrics": [
+			{"name": "a", "objectName": "o", "objectInstance": "i", "counterId": "0001", "type": "gauge", "unit": "ms", "description": "d"}
+		]}]}}]`
+	configs, errs := ParseXappConfigs([]byte(descriptor))
+	assert.Empty(t, errs)
+	assert.Len(t, configs, 1)
+	assert.Equal(t, "app1", configs[0].Metadata.XappName)
+	assert.Equal(t, Metric{Name: "a", ObjectName: "o", ObjectInstance: "i", CounterId: "0001", Type: "gauge", Unit: "ms", Description: "d"},
+		configs[0].Config.Measurements[0].Metrics[0])
+
+	vesconf, _, _ := NewVespaMgr().buildCurrentConfig([]byte(descriptor))
+	keys := vesconf.Measurement.Prometheus.Rules.Metrics[0].ObjectKeys
+	assert.Contains(t, keys, Label{Name: "counterType", Expr: "gauge"})
+	assert.Contains(t, keys, Label{Name: "unit", Expr: "ms"})
+}
+
+func TestSameCounterNameInDifferentXApps(t *testing.T) {
+	descriptor := `[
+		{"metadata": {"xappName": "app1"}, "config": {"measurements": [{"moId": "SEP/XAPP-1", "measType": "X2", "measId": "1", "measInterval": "60", "metrics": [
+			{"name": "ricxapp_RMR_Received", "objectName": "o", "objectInstance": "i", "counterId": "0001"}]}]}},
+		{"metadata": {"xappName": "app2"}, "config": {"measurements": [{"moId": "SEP/XAPP-2", "measType": "X2", "measId": "1", "measInterval": "60", "metrics": [
+			{"name": "ricxapp_RMR_Received", "objectName": "o", "objectInstance": "i", "counterId": "0001"}]}]}},
+		{"metadata": {"xappName": "app3"}, "config": {"measurements": [{"moId": "SEP/XAPP-2", "measType": "X2", "measId": "1", "measInterval": "60", "metrics": [
+			{"name": "ricxapp_SDL_Stored", "objectName": "o", "objectInstance": "i", "counterId": "0001"}]}]}}
+	]`
+	appMetrics := make(AppMetrics)
+	errs := vespaMgr.parseDescriptor([]byte(descriptor), appMetrics)
+
+	assert.Len(t, appMetrics, 2)
+	assert.Equal(t, "SEP/XAPP-1", appMetrics["app1/ricxapp_RMR_Received"].MoId)
+	assert.Equal(t, "SEP/XAPP-2", appMetrics["app2/ricxapp_RMR_Received"].MoId)
+	assert.Len(t, errs, 1)
+	assert.Equal(t, "app3", errs[0].XApp)
+	assert.Equal(t, reasonConflict+" with app2/ricxapp_RMR_Received", errs[0].Reason)
+}
+
+func TestSameCounterNameInXAppInstances(t *testing.T) {
+	descriptor := `[
+		{"metadata": {"xappName": "app1", "namespace": "ricxapp"}, "config": {"measurements": [{"moId": "SEP/XAPP-1", "measType": "X2", "measId": "1", "measInterval": "60", "metrics": [
+			{"name": "ricxapp_RMR_Received", "objectName": "o", "objectInstance": "i", "counterId": "0001"}]}]}},
+		{"metadata": {"xappName": "app1", "namespace": "ricxapp-test"}, "config": {"measurements": [{"moId": "SEP/XAPP-1", "measType": "X2", "measId": "1", "measInterval": "60", "metrics": [
+			{"name": "ricxapp_RMR_Received", "objectName": "o", "objectInstance": "i", "counterId": "0001"}]}]}},
+		{"metadata": {"xappName": "app1", "namespace": "ricxapp"}, "config": {"measurements": [{"moId": "SEP/XAPP-1", "measType": "X2", "measId": "2", "measInterval": "60", "metrics": [
+			{"name": "ricxapp_RMR_Received", "objectName": "o", "objectInstance": "i", "counterId": "0002"}]}]}}
+	]`
+	appMetrics := make(AppMetrics)
+	errs := vespaMgr.parseDescriptor([]byte(descriptor), appMetrics)
+
+	assert.Len(t, appMetrics, 2)
+	assert.Equal(t, "ricxapp", appMetrics["ricxapp/app1/ricxapp_RMR_Received"].Namespace)
+	assert.Equal(t, "ricxapp-test", appMetrics["ricxapp-test/app1/ricxapp_RMR_Received"].Namespace)
+	assert.Len(t, errs, 1)
+	assert.Equal(t, reasonDuplicate, errs[0].Reason)
+}
+
+func TestXAppInstancesWithSameDescriptor(t *testing.T) {
+	entry := `"config": {"measurements": [{"moId": "SEP/XAPP-1", "measType": "X2", "measId": "1", "measInterval": "60", "metrics": [
+		{"name": "ricxapp_RMR_Received", "objectName": "o", "objectInstance": "i", "counterId": "0001"}]}]}`
+	descriptor := `[{"metadata": {"xappName": "app1", "namespace": "ns1"}, ` + entry + `},
+		{"metadata": {"xappName": "app1", "namespace": "ns2"}, ` + entry + `}]`
+
+	vesconf, _, errs := NewVespaMgr().buildCurrentConfig([]byte(descriptor))
+	assert.Empty(t, errs)
+	rules := vesconf.Measurement.Prometheus.Rules.Metrics
+	assert.Len(t, rules, 2)
+	assert.Equal(t, `ricxapp_RMR_Received{kubernetes_name=~"service-ricxapp-app1-(http|rmr)",kubernetes_namespace="ns1"}`, rules[0].Expr)
+	assert.Equal(t, `ricxapp_RMR_Received{kubernetes_name=~"service-ricxapp-app1-(http|rmr)",kubernetes_namespace="ns2"}`, rules[1].Expr)
+	assert.Contains(t, rules[0].ObjectKeys, Label{Name: "namespace", Expr: "ns1"})
+	assert.Contains(t, rules[1].ObjectKeys, Label{Name: "namespace", Expr: "ns2"})
+}
+
+func TestMetricExprIsScopedToXApp(t *testing.T) {
+	selector := MetricSelector{XApp: `kubernetes_name=~"service-ricxapp-%s-(http|rmr)"`}
+	assert.Equal(t, "counter", metricExpr(AppMetricsStruct{Name: "counter"}, selector))
+	assert.Equal(t, "counter", metricExpr(AppMetricsStruct{XApp: "app1", Name: "counter"}, MetricSelector{}))
+	assert.Equal(t, `counter{kubernetes_name=~"service-ricxapp-app1-(http|rmr)"}`,
+		metricExpr(AppMetricsStruct{XApp: "app1", Name: "counter"}, selector))
+	assert.Equal(t, `counter{kubernetes_name=~"service-ricxapp-app1-(http|rmr)"}`,
+		metricExpr(AppMetricsStruct{XApp: "app1", Name: "counter{}"}, selector))
+	assert.Equal(t, `counter{POD_NAME='e2term',kubernetes_name=~"service-ricxapp-app1-(http|rmr)"}`,
+		metricExpr(AppMetricsStruct{XApp: "app1", Name: "counter{POD_NAME='e2term'}"}, selector))
+
+	// The name is matched literally
+	assert.Equal(t, `counter{kubernetes_name=~"service-ricxapp-app\\.1-(http|rmr)"}`,
+		metricExpr(AppMetricsStruct{XApp: "app.1", Name: "counter"}, selector))
+
+	selector.Namespace = `kubernetes_namespace="%s"`
+	assert.Equal(t, `counter{kubernetes_name=~"service-ricxapp-app1-(http|rmr)",kubernetes_namespace="ns1"}`,
+		metricExpr(AppMetricsStruct{XApp: "app1", Namespace: "ns1", Name: "counter"}, selector))
+	assert.Equal(t, "counter", metricExpr(AppMetricsStruct{Namespace: "ns1", Name: "counter"}, selector))
+}
+
+func TestSecondaryCollectorConfiguration(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	NewVespaMgr().CreateConfig(buffer, []byte{})
+	var vesconf VESAgentConfiguration
+	err := yaml.Unmarshal(buffer.Bytes(), &vesconf)
+	assert.Nil(t, err)
+
+	assert.Equal(t, "localhost", vesconf.BackupCollector.FQDN)
+	assert.Equal(t, 8443, vesconf.BackupCollector.Port)
+	assert.Equal(t, "sample1", vesconf.BackupCollector.User)
+	assert.Equal(t, vesconf.PrimaryCollector.ServerRoot, vesconf.BackupCollector.ServerRoot)
+	// controls.collector.secondarySecure overrides the secure flag of the primary collector
+	assert.False(t, vesconf.PrimaryCollector.Secure)
+	assert.True(t, vesconf.BackupCollector.Secure)
+}
+
+func TestSecondaryCollectorUsesAgentKey(t *testing.T) {
+	buffer := new(bytes.Buffer)
+	NewVespaMgr().CreateConfig(buffer, []byte{})
+
+	// The VES agent reads the failover collector from backupCollector
+	var agentConf struct {
+		BackupCollector struct {
+			FQDN string `yaml:"fqdn"`
+			Port int    `yaml:"port"`
+		} `yaml:"backupCollector"`
+	}
+	assert.Nil(t, yaml.Unmarshal(buffer.Bytes(), &agentConf))
+	assert.Equal(t, "localhost", agentConf.BackupCollector.FQDN)
+	assert.Equal(t, 8443, agentConf.BackupCollector.Port)
+	assert.NotContains(t, buffer.String(), "secondaryCollector")
+}
+
+func TestSecondaryCollectorIsOmittedWhenNotConfigured(t *testing.T) {
+	out, err := yaml.Marshal(VESAgentConfiguration{PrimaryCollector: CollectorConfiguration{FQDN: "collector"}})
+	assert.Nil(t, err)
+	assert.NotContains(t, string(out), "backupCollector")
+}
+
+func TestResolveCredential(t *testing.T) {
+	value, err := resolveCredential("plain", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "plain", value)
+
+	os.Setenv("VESMGR_TEST_PASSWORD", "from-env")
+	defer os.Unsetenv("VESMGR_TEST_PASSWORD")
+	value, err = resolveCredential("env:VESMGR_TEST_PASSWORD", "")
+	assert.Nil(t, err)
+	assert.Equal(t, "from-env", value)
+
+	_, err = resolveCredential("env:VESMGR_TEST_NOT_SET", "")
+	assert.NotNil(t, err)
+
+	f, err := ioutil.TempFile("", "secret")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("from-file\n")
+	f.Close()
+	value, err = resolveCredential("ignored", f.Name())
+	assert.Nil(t, err)
+	assert.Equal(t, "from-file", value)
+
+	_, err = resolveCredential("", "/nonexistent/secret")
+	assert.NotNil(t, err)
+}
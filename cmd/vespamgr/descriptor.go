@@ -0,0 +1,249 @@
+/*
+ *  Copyright (c) 2020 AT&T Intellectual Property.
+ *  Copyright (c) 2020 Nokia.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  This source code is part of the near-RT RIC (RAN Intelligent Controller)
+ *  platform project (RICP).
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+
+	app "gerrit.o-ran-sc.org/r/ric-plt/xapp-frame/pkg/xapp"
+)
+
+// jsonField binds a member of a JSON object to the value it is decoded into
+type jsonField struct {
+	name     string
+	target   interface{}
+	required bool
+}
+
+// fieldProblem tells why a member of a JSON object was not accepted
+type fieldProblem struct {
+	field    string
+	reason   string
+	severity string
+}
+
+// decodeObject decodes the members of a JSON object into their targets one by one,
+// so that a wrongly-typed member does not hide the problems of the others. In strict
+// mode the members which are not listed in fields are reported as warnings. The
+// returned flag is false if the JSON value is not an object at all.
+func decodeObject(raw json.RawMessage, fields []jsonField, strict bool) ([]fieldProblem, bool) {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &members); err != nil || members == nil {
+		return nil, false
+	}
+
+	var problems []fieldProblem
+	known := make(map[string]bool)
+	for _, f := range fields {
+		known[f.name] = true
+		value, found := members[f.name]
+		if !found || string(value) == "null" {
+			if f.required {
+				problems = append(problems, fieldProblem{f.name, reasonMissing, severityError})
+			}
+			continue
+		}
+		if err := json.Unmarshal(value, f.target); err != nil {
+			problems = append(problems, fieldProblem{f.name, reasonForType(f.target), severityError})
+		}
+	}
+
+	if strict {
+		var unknown []string
+		for name := range members {
+			if !known[name] {
+				unknown = append(unknown, name)
+			}
+		}
+		sort.Strings(unknown)
+		for _, name := range unknown {
+			problems = append(problems, fieldProblem{name, reasonUnknownField, severityWarning})
+		}
+	}
+	return problems, true
+}
+
+func reasonForType(target interface{}) string {
+	switch reflect.TypeOf(target).Elem().Kind() {
+	case reflect.String:
+		return reasonNotString
+	case reflect.Slice, reflect.Array:
+		return reasonNotArray
+	case reflect.Struct, reflect.Map:
+		return reasonNotObject
+	}
+	return reasonInvalidValue
+}
+
+func hasErrors(errs []ValidationError) bool {
+	for _, e := range errs {
+		if e.Severity == severityError {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseXappConfigs decodes the xApp configuration list returned by appmgr, which is
+// expected to be a JSON array of the following format:
+//
+//	[{ "metadata": { "xappName": "..." },
+//	   "config": { "measurements": [ { "moId": "...", ..., "metrics": [ ... ] } ] } }]
+//
+// Only the valid measurements and metrics are returned, the rejected ones are reported
+// as validation errors.
+func ParseXappConfigs(data []byte) ([]XappConfig, []ValidationError) {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, nil
+	}
+
+	var entries []json.RawMessage
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, []ValidationError{{Severity: severityError, Reason: fmt.Sprintf("%s: %v", reasonInvalidJSON, err)}}
+	}
+
+	var configs []XappConfig
+	var errs []ValidationError
+	for i, entry := range entries {
+		var config XappConfig
+		var configRaw json.RawMessage
+		problems, ok := decodeObject(entry, []jsonField{
+			{name: "metadata", target: &config.Metadata},
+			{name: "config", target: &configRaw},
+		}, false)
+		if !ok {
+			errs = append(errs, ValidationError{Severity: severityError, Field: fmt.Sprintf("[%d]", i), Reason: reasonNotObject})
+			continue
+		}
+		xappName := config.Metadata.XappName
+		for _, p := range problems {
+			errs = append(errs, ValidationError{Severity: p.severity, XApp: xappName, Field: p.field, Reason: p.reason})
+		}
+
+		measurements, measurementErrs := decodeMeasurements(configRaw, xappName)
+		errs = append(errs, measurementErrs...)
+		config.Config.Measurements = measurements
+		configs = append(configs, config)
+	}
+	return configs, errs
+}
+
+func decodeMeasurements(configRaw json.RawMessage, xappName string) ([]Measurement, []ValidationError) {
+	if configRaw == nil {
+		app.Logger.Info("No xApp config found!")
+		return nil, nil
+	}
+
+	var measurementsRaw json.RawMessage
+	if _, ok := decodeObject(configRaw, []jsonField{{name: "measurements", target: &measurementsRaw}}, false); !ok {
+		return nil, []ValidationError{{Severity: severityError, XApp: xappName, Field: "config", Reason: reasonNotObject}}
+	}
+	if measurementsRaw == nil {
+		app.Logger.Info("No xApp metrics found!")
+		return nil, nil
+	}
+
+	var entries []json.RawMessage
+	if err := json.Unmarshal(measurementsRaw, &entries); err != nil {
+		return nil, []ValidationError{{Severity: severityError, XApp: xappName, Field: "measurements", Reason: reasonNotArray}}
+	}
+
+	var measurements []Measurement
+	var errs []ValidationError
+	for i, entry := range entries {
+		measurement, measurementErrs, ok := decodeMeasurement(entry, fmt.Sprintf("#%d", i), xappName)
+		errs = append(errs, measurementErrs...)
+		if ok {
+			measurements = append(measurements, measurement)
+		}
+	}
+	return measurements, errs
+}
+
+// decodeMeasurement decodes a measurement and its valid metrics. The returned flag
+// is false if the measurement itself is rejected.
+func decodeMeasurement(raw json.RawMessage, index, xappName string) (Measurement, []ValidationError, bool) {
+	var m Measurement
+	var metrics []json.RawMessage
+	problems, ok := decodeObject(raw, []jsonField{
+		{name: "moId", target: &m.MoId, required: true},
+		{name: "measType", target: &m.MeasType, required: true},
+		{name: "measId", target: &m.MeasId, required: true},
+		{name: "measInterval", target: &m.MeasInterval, required: true},
+		{name: "metrics", target: &metrics, required: true},
+	}, true)
+	if !ok {
+		return m, []ValidationError{{Severity: severityError, XApp: xappName, Measurement: index, Reason: reasonNotObject}}, false
+	}
+
+	measId := m.MeasId
+	if measId == "" {
+		measId = index
+	}
+	var errs []ValidationError
+	for _, p := range problems {
+		errs = append(errs, ValidationError{Severity: p.severity, XApp: xappName, Measurement: measId, Field: p.field, Reason: p.reason})
+	}
+	if hasErrors(errs) {
+		app.Logger.Info("No metrics found for moId=%s measType=%s measId=%s measInterval=%s", m.MoId, m.MeasType, m.MeasId, m.MeasInterval)
+		return m, errs, false
+	}
+
+	for i, entry := range metrics {
+		metric, metricErrs := decodeMetric(entry, fmt.Sprintf("#%d", i), xappName, measId)
+		errs = append(errs, metricErrs...)
+		if !hasErrors(metricErrs) {
+			m.Metrics = append(m.Metrics, metric)
+		}
+	}
+	return m, errs, true
+}
+
+func decodeMetric(raw json.RawMessage, index, xappName, measId string) (Metric, []ValidationError) {
+	var metric Metric
+	problems, ok := decodeObject(raw, []jsonField{
+		{name: "name", target: &metric.Name, required: true},
+		{name: "objectName", target: &metric.ObjectName, required: true},
+		{name: "objectInstance", target: &metric.ObjectInstance, required: true},
+		{name: "counterId", target: &metric.CounterId, required: true},
+		{name: "type", target: &metric.Type},
+		{name: "unit", target: &metric.Unit},
+		{name: "description", target: &metric.Description},
+	}, true)
+	if !ok {
+		return metric, []ValidationError{{Severity: severityError, XApp: xappName, Measurement: measId, Metric: index, Reason: reasonNotObject}}
+	}
+
+	name := metric.Name
+	if name == "" {
+		name = index
+	}
+	var errs []ValidationError
+	for _, p := range problems {
+		errs = append(errs, ValidationError{Severity: p.severity, XApp: xappName, Measurement: measId, Metric: name, Field: p.field, Reason: p.reason})
+	}
+	return metric, errs
+}
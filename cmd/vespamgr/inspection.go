@@ -0,0 +1,265 @@
+/*
+ *  Copyright (c) 2020 AT&T Intellectual Property.
+ *  Copyright (c) 2020 Nokia.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  This source code is part of the near-RT RIC (RAN Intelligent Controller)
+ *  platform project (RICP).
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	app "gerrit.o-ran-sc.org/r/ric-plt/xapp-frame/pkg/xapp"
+	"gopkg.in/yaml.v2"
+)
+
+// Credentials are replaced with this in the configuration shown over REST
+const redacted = "*****"
+
+// Source of the rules and problems of a previewed descriptor
+const previewSource = "descriptor"
+
+// RuleSource tells where the metric of a rule was defined
+type RuleSource struct {
+	Source         string `json:"source"` // appmgr, pltFile/<component> or pltCounterFile
+	XApp           string `json:"xapp,omitempty"`
+	Name           string `json:"name"`
+	Expr           string `json:"expr"`
+	ObjectName     string `json:"objectName"`
+	ObjectInstance string `json:"objectInstance"`
+}
+
+// RulePreview is the response to previewing the rules of a measurement descriptor
+type RulePreview struct {
+	Valid    bool              `json:"valid"` // False if parts of the descriptor were rejected
+	Rules    interface{}       `json:"rules"` // Rules with the field names of the VES agent configuration
+	Sources  []RuleSource      `json:"sources"`
+	Warnings []ValidationError `json:"warnings"`
+}
+
+// AppliedStatus identifies the VES agent configuration written last
+type AppliedStatus struct {
+	File string    `json:"file"`
+	Time time.Time `json:"time"`
+	Hash string    `json:"hash"` // SHA-256 of the configuration file content
+
+	config *VESAgentConfiguration
+}
+
+// setAppliedStatus stores the VES agent configuration written last, with the
+// sources of its rules and the problems found in the descriptors, so that the
+// inspection endpoints and the validation report describe the same configuration.
+// A nil data tells that the written configuration did not change, and only the
+// sources and the problems are updated.
+func (v *VespaMgr) setAppliedStatus(vespaconf *VESAgentConfiguration, data []byte, sources []RuleSource, errs []ValidationError) {
+	if errs == nil {
+		errs = []ValidationError{}
+	}
+
+	v.reportMu.Lock()
+	defer v.reportMu.Unlock()
+	if data != nil {
+		hash := sha256.Sum256(data)
+		v.appliedStatus = AppliedStatus{
+			File:   app.Config.GetString("controls.vesagent.configFile"),
+			Time:   time.Now(),
+			Hash:   hex.EncodeToString(hash[:]),
+			config: vespaconf,
+		}
+	}
+	v.ruleSources = sources
+	v.validationReport = ValidationReport{Time: time.Now(), Errors: errs}
+}
+
+// HandleEffectiveConfig returns the VES agent configuration written last, with the
+// collector credentials redacted. The configuration is returned as YAML if asked
+// with the query parameter format=yaml or in the Accept header, otherwise as JSON
+// with the same field names.
+func (v *VespaMgr) HandleEffectiveConfig(w http.ResponseWriter, r *http.Request) {
+	v.reportMu.Lock()
+	status := v.appliedStatus
+	v.reportMu.Unlock()
+
+	if status.config == nil {
+		v.respondWithError(w, http.StatusNotFound, fmt.Errorf("no VES agent configuration written yet"))
+		return
+	}
+
+	data, err := yaml.Marshal(redactConfig(*status.config))
+	if err != nil {
+		v.respondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "yaml" || strings.Contains(r.Header.Get("Accept"), "yaml") {
+		w.Header().Set("Content-Type", "application/yaml")
+		w.WriteHeader(http.StatusOK)
+		w.Write(data)
+		return
+	}
+
+	generic, err := yamlToJSON(data)
+	if err != nil {
+		v.respondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	v.respondWithJSON(w, http.StatusOK, generic)
+}
+
+// HandleRules returns the metric rules of the configuration generated last, with
+// the source of each rule
+func (v *VespaMgr) HandleRules(w http.ResponseWriter, r *http.Request) {
+	v.reportMu.Lock()
+	sources := v.ruleSources
+	v.reportMu.Unlock()
+
+	if sources == nil {
+		sources = []RuleSource{}
+	}
+	v.respondWithJSON(w, http.StatusOK, sources)
+}
+
+// HandleAppliedStatus tells when the VES agent configuration was written last
+func (v *VespaMgr) HandleAppliedStatus(w http.ResponseWriter, r *http.Request) {
+	v.reportMu.Lock()
+	status := v.appliedStatus
+	v.reportMu.Unlock()
+
+	if status.config == nil {
+		v.respondWithError(w, http.StatusNotFound, fmt.Errorf("no VES agent configuration written yet"))
+		return
+	}
+	v.respondWithJSON(w, http.StatusOK, status)
+}
+
+// HandleRulePreview returns the metric rules which would be created for the posted
+// xApp descriptor, or list of descriptors, and the problems found in it, including
+// clashes with the measurements in use. The live VES agent configuration and the
+// validation report are not touched.
+func (v *VespaMgr) HandleRulePreview(w http.ResponseWriter, r *http.Request) {
+	descriptor, err := v.ReadPayload(w, r)
+	if err != nil {
+		return
+	}
+	if trimmed := bytes.TrimSpace(descriptor); len(trimmed) > 0 && trimmed[0] == '{' {
+		descriptor = append(append([]byte("["), trimmed...), ']')
+	}
+
+	allRules, allSources, allErrs := v.buildRules(v.previewSources(descriptor), configuredSelector())
+	rules := []MetricRule{}
+	sources := []RuleSource{}
+	for i, source := range allSources {
+		if source.Source == previewSource {
+			rules = append(rules, allRules[i])
+			sources = append(sources, source)
+		}
+	}
+	errs := []ValidationError{}
+	for _, e := range allErrs {
+		if e.Source == previewSource {
+			errs = append(errs, e)
+		}
+	}
+
+	data, err := yaml.Marshal(rules)
+	if err != nil {
+		v.respondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	generic, err := yamlToJSON(data)
+	if err != nil {
+		v.respondWithError(w, http.StatusInternalServerError, err)
+		return
+	}
+	v.respondWithJSON(w, http.StatusOK, RulePreview{Valid: !hasErrors(errs), Rules: generic, Sources: sources, Warnings: errs})
+}
+
+// previewSources returns the descriptor to preview after the descriptors in use, so
+// that its clashes with the deployed xApps and the platform measurements are found.
+// The deployed configurations of the previewed xApps are left out, as they would be
+// replaced by the descriptor.
+func (v *VespaMgr) previewSources(descriptor []byte) []descriptorSource {
+	v.confMu.Lock()
+	entries := v.xappEntries
+	pltSources := v.platformSources()
+	v.confMu.Unlock()
+
+	previewed := make(map[string]bool)
+	if posted, err := splitXappConfigs(descriptor); err == nil {
+		for _, entry := range posted {
+			if instance := xappEntryMetadata(entry).Instance(); instance != "" {
+				previewed[instance] = true
+			}
+		}
+	}
+	deployed := make(map[string]json.RawMessage)
+	for key, entry := range entries {
+		if !previewed[xappEntryMetadata(entry).Instance()] {
+			deployed[key] = entry
+		}
+	}
+
+	sources := append([]descriptorSource{{name: "appmgr", descriptor: joinXappConfigs(deployed)}}, pltSources...)
+	return append(sources, descriptorSource{name: previewSource, descriptor: descriptor})
+}
+
+func redactConfig(vespaconf VESAgentConfiguration) VESAgentConfiguration {
+	for _, collector := range []*CollectorConfiguration{&vespaconf.PrimaryCollector, &vespaconf.BackupCollector} {
+		if collector.Password != "" {
+			collector.Password = redacted
+		}
+		if collector.PassPhrase != "" {
+			collector.PassPhrase = redacted
+		}
+	}
+	return vespaconf
+}
+
+// yamlToJSON decodes YAML into values which can be encoded as JSON
+func yamlToJSON(data []byte) (interface{}, error) {
+	var generic interface{}
+	if err := yaml.Unmarshal(data, &generic); err != nil {
+		return nil, err
+	}
+	return jsonCompatible(generic), nil
+}
+
+// jsonCompatible converts the maps decoded from YAML, which have interface{} keys,
+// into maps with string keys which can be encoded as JSON
+func jsonCompatible(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			m[fmt.Sprint(k)] = jsonCompatible(v)
+		}
+		return m
+	case []interface{}:
+		for i, v := range value {
+			value[i] = jsonCompatible(v)
+		}
+	}
+	return value
+}
@@ -0,0 +1,182 @@
+/*
+ *  Copyright (c) 2020 AT&T Intellectual Property.
+ *  Copyright (c) 2020 Nokia.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  This source code is part of the near-RT RIC (RAN Intelligent Controller)
+ *  platform project (RICP).
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+func TestInspectEffectiveConfig(t *testing.T) {
+	fname := fmt.Sprintf("%s/ves-agent-inspect-%d.yaml", os.TempDir(), os.Getpid())
+	defer os.Remove(fname)
+
+	vespaMgr := NewVespaMgr()
+	req, _ := http.NewRequest("GET", "/ric/v1/vesagent/config", nil)
+	response := executeRequest(req, http.HandlerFunc(vespaMgr.HandleEffectiveConfig))
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	xappConfig := []byte(`[` + xappConfigEntry("app1", "c1") + `]`)
+	assert.True(t, vespaMgr.CreateConf(fname, xappConfig))
+	assert.Equal(t, "sample1", vespaMgr.appliedConf.PrimaryCollector.Password)
+
+	response = executeRequest(req, http.HandlerFunc(vespaMgr.HandleEffectiveConfig))
+	assert.Equal(t, http.StatusOK, response.Code)
+	var conf map[string]interface{}
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &conf))
+	collector := conf["primaryCollector"].(map[string]interface{})
+	assert.Equal(t, redacted, collector["password"])
+	assert.Equal(t, "sample1", collector["user"])
+
+	req, _ = http.NewRequest("GET", "/ric/v1/vesagent/config?format=yaml", nil)
+	response = executeRequest(req, http.HandlerFunc(vespaMgr.HandleEffectiveConfig))
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "application/yaml", response.Header().Get("Content-Type"))
+	var yamlConf VESAgentConfiguration
+	assert.Nil(t, yaml.Unmarshal(response.Body.Bytes(), &yamlConf))
+	assert.Equal(t, redacted, yamlConf.PrimaryCollector.Password)
+	assert.Equal(t, 1, len(yamlConf.Measurement.Prometheus.Rules.Metrics))
+}
+
+func TestInspectRulesAndStatus(t *testing.T) {
+	fname := fmt.Sprintf("%s/ves-agent-inspect-%d.yaml", os.TempDir(), os.Getpid())
+	defer os.Remove(fname)
+
+	vespaMgr := NewVespaMgr()
+	req, _ := http.NewRequest("GET", "/ric/v1/vesagent/status", nil)
+	response := executeRequest(req, http.HandlerFunc(vespaMgr.HandleAppliedStatus))
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	assert.True(t, vespaMgr.CreateConf(fname, []byte(`[`+xappConfigEntry("app1", "c1")+`]`)))
+
+	response = executeRequest(req, http.HandlerFunc(vespaMgr.HandleAppliedStatus))
+	assert.Equal(t, http.StatusOK, response.Code)
+	var status AppliedStatus
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &status))
+	written, _ := ioutil.ReadFile(fname)
+	hash := sha256.Sum256(written)
+	assert.Equal(t, hex.EncodeToString(hash[:]), status.Hash)
+	assert.False(t, status.Time.IsZero())
+
+	req, _ = http.NewRequest("GET", "/ric/v1/vesagent/rules", nil)
+	response = executeRequest(req, http.HandlerFunc(vespaMgr.HandleRules))
+	assert.Equal(t, http.StatusOK, response.Code)
+	var sources []RuleSource
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &sources))
+	assert.Equal(t, 1, len(sources))
+	assert.Equal(t, "appmgr", sources[0].Source)
+	assert.Equal(t, "app1", sources[0].XApp)
+	assert.Equal(t, "c1", sources[0].Name)
+	assert.Contains(t, sources[0].Expr, "c1{")
+	assert.Equal(t, "obj", sources[0].ObjectName)
+}
+
+func TestRulePreview(t *testing.T) {
+	vespaMgr := NewVespaMgr()
+	descriptor := `{"metadata": {"xappName": "app1"}, "config": {"measurements": [{"moId": "SEP/app1", "measType": "X2",
+		"measId": "1", "measInterval": "60", "metrics": [
+			{"name": "c1", "objectName": "obj", "objectInstance": "inst", "counterId": "1"},
+			{"name": "c2", "objectName": "obj"}]}]}}`
+
+	req, _ := http.NewRequest("POST", "/ric/v1/vesagent/preview", bytes.NewBufferString(descriptor))
+	req.Header.Set("Content-Type", "application/json")
+	response := executeRequest(req, http.HandlerFunc(vespaMgr.HandleRulePreview))
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	var preview struct {
+		Valid    bool                     `json:"valid"`
+		Rules    []map[string]interface{} `json:"rules"`
+		Sources  []RuleSource             `json:"sources"`
+		Warnings []ValidationError        `json:"warnings"`
+	}
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &preview))
+	assert.False(t, preview.Valid)
+	assert.Equal(t, 1, len(preview.Rules))
+	assert.Equal(t, "AdditionalObjects", preview.Rules[0]["target"])
+	assert.Equal(t, "inst:1", preview.Rules[0]["object_instance"])
+	assert.Equal(t, 1, len(preview.Sources))
+	assert.Equal(t, "descriptor", preview.Sources[0].Source)
+	assert.NotEmpty(t, preview.Warnings)
+	for _, w := range preview.Warnings {
+		assert.Equal(t, "app1", w.XApp)
+		assert.Equal(t, "c2", w.Metric)
+	}
+
+	// The live configuration state is left as it was
+	assert.Empty(t, vespaMgr.ValidationReport().Errors)
+	assert.Nil(t, vespaMgr.ruleSources)
+	assert.Nil(t, vespaMgr.appliedStatus.config)
+}
+
+func TestRulePreviewList(t *testing.T) {
+	vespaMgr := NewVespaMgr()
+	descriptor := `[` + xappConfigEntry("app1", "c1") + `,` + xappConfigEntry("app2", "c1") + `]`
+
+	req, _ := http.NewRequest("POST", "/ric/v1/vesagent/preview", bytes.NewBufferString(descriptor))
+	response := executeRequest(req, http.HandlerFunc(vespaMgr.HandleRulePreview))
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	var preview RulePreview
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &preview))
+	assert.True(t, preview.Valid)
+	assert.Equal(t, 2, len(preview.Sources))
+	assert.Empty(t, preview.Warnings)
+
+	req, _ = http.NewRequest("POST", "/ric/v1/vesagent/preview", bytes.NewBufferString(`{"metadata":`))
+	response = executeRequest(req, http.HandlerFunc(vespaMgr.HandleRulePreview))
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
+
+func TestRulePreviewWithDeployedXapps(t *testing.T) {
+	vespaMgr := NewVespaMgr()
+	deployed := `[` + xappConfigEntry("app1", "c1") + `,` + strings.Replace(xappConfigEntry("other", "c3"), "SEP/other", "SEP/app2", 1) + `]`
+	entries, err := splitXappConfigs([]byte(deployed))
+	assert.Nil(t, err)
+	vespaMgr.xappEntries = entries
+
+	// The deployed configuration of app1 is replaced, the one of app2 clashes with other
+	descriptor := `[` + xappConfigEntry("app1", "c1") + `,` + xappConfigEntry("app2", "c2") + `]`
+	req, _ := http.NewRequest("POST", "/ric/v1/vesagent/preview", bytes.NewBufferString(descriptor))
+	response := executeRequest(req, http.HandlerFunc(vespaMgr.HandleRulePreview))
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	var preview RulePreview
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &preview))
+	assert.False(t, preview.Valid)
+	assert.Equal(t, 1, len(preview.Sources))
+	assert.Equal(t, "descriptor", preview.Sources[0].Source)
+	assert.Equal(t, "app1", preview.Sources[0].XApp)
+	assert.Equal(t, 1, len(preview.Warnings))
+	assert.Equal(t, "descriptor", preview.Warnings[0].Source)
+	assert.Equal(t, "app2", preview.Warnings[0].XApp)
+	assert.Contains(t, preview.Warnings[0].Reason, reasonConflict)
+}
@@ -0,0 +1,256 @@
+/*
+ *  Copyright (c) 2020 AT&T Intellectual Property.
+ *  Copyright (c) 2020 Nokia.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  This source code is part of the near-RT RIC (RAN Intelligent Controller)
+ *  platform project (RICP).
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	app "gerrit.o-ran-sc.org/r/ric-plt/xapp-frame/pkg/xapp"
+	"github.com/gorilla/mux"
+)
+
+// The platform component of the measurements posted without a component name
+const defaultPltComponent = "default"
+
+// PltMeasurementList is the response to listing the platform measurements
+type PltMeasurementList struct {
+	Components   map[string]json.RawMessage `json:"components"`   // Measurement descriptor of each platform component
+	Measurements json.RawMessage            `json:"measurements"` // Descriptors of all components merged
+}
+
+// HandleMeasurements replaces the platform measurements of the default component
+func (v *VespaMgr) HandleMeasurements(w http.ResponseWriter, r *http.Request) {
+	descriptor, _, ok := v.readPltDescriptor(w, r)
+	if !ok {
+		return
+	}
+
+	err := v.updatePltStore(func(store map[string]json.RawMessage) { store[defaultPltComponent] = descriptor })
+	if err != nil {
+		app.Logger.Error("Unable to store platform measurements: %v", err)
+		v.respondWithError(w, http.StatusInternalServerError, fmt.Errorf("unable to store the measurements"))
+		return
+	}
+	v.respondWithJSON(w, http.StatusOK, nil)
+
+	go v.reconfigureVesagent(false)
+}
+
+// HandleMeasurementList returns the platform measurements of all components
+func (v *VespaMgr) HandleMeasurementList(w http.ResponseWriter, r *http.Request) {
+	store, err := readPltStore(app.Config.GetString("controls.pltFile"))
+	if err != nil {
+		app.Logger.Error("Unable to read platform measurements: %v", err)
+		v.respondWithError(w, http.StatusInternalServerError, fmt.Errorf("unable to read the measurements"))
+		return
+	}
+	v.respondWithJSON(w, http.StatusOK, PltMeasurementList{Components: store, Measurements: mergePltStore(store)})
+}
+
+// HandleComponentMeasurements reads, replaces or deletes the platform measurements
+// of a single component, e.g. e2term. The measurements are validated like the
+// measurements of an xApp descriptor.
+func (v *VespaMgr) HandleComponentMeasurements(w http.ResponseWriter, r *http.Request) {
+	component := mux.Vars(r)["component"]
+	if component == "" {
+		v.respondWithError(w, http.StatusBadRequest, fmt.Errorf("invalid component '%s'", component))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		store, err := readPltStore(app.Config.GetString("controls.pltFile"))
+		if err != nil {
+			app.Logger.Error("Unable to read platform measurements: %v", err)
+			v.respondWithError(w, http.StatusInternalServerError, fmt.Errorf("unable to read the measurements"))
+			return
+		}
+		if descriptor, found := store[component]; found {
+			v.respondWithJSON(w, http.StatusOK, descriptor)
+		} else {
+			v.respondWithError(w, http.StatusNotFound, fmt.Errorf("no measurements for component '%s'", component))
+		}
+
+	case http.MethodPut:
+		descriptor, errs, ok := v.readPltDescriptor(w, r)
+		if !ok {
+			return
+		}
+
+		err := v.updatePltStore(func(store map[string]json.RawMessage) { store[component] = descriptor })
+		if err != nil {
+			app.Logger.Error("Unable to store platform measurements: %v", err)
+			v.respondWithError(w, http.StatusInternalServerError, fmt.Errorf("unable to store the measurements"))
+			return
+		}
+		if errs == nil {
+			errs = []ValidationError{}
+		}
+		v.respondWithJSON(w, http.StatusOK, map[string]interface{}{"component": component, "warnings": errs})
+		go v.reconfigureVesagent(false)
+
+	case http.MethodDelete:
+		found := false
+		err := v.updatePltStore(func(store map[string]json.RawMessage) {
+			_, found = store[component]
+			delete(store, component)
+		})
+		if err != nil {
+			app.Logger.Error("Unable to store platform measurements: %v", err)
+			v.respondWithError(w, http.StatusInternalServerError, fmt.Errorf("unable to store the measurements"))
+			return
+		}
+		if !found {
+			v.respondWithError(w, http.StatusNotFound, fmt.Errorf("no measurements for component '%s'", component))
+			return
+		}
+		v.respondWithJSON(w, http.StatusNoContent, nil)
+		go v.reconfigureVesagent(false)
+	}
+}
+
+// readPltDescriptor reads a platform measurement descriptor from the request, and
+// validates it like the measurements of an xApp descriptor. An invalid descriptor
+// is answered with the validation errors, and false is returned in ok.
+func (v *VespaMgr) readPltDescriptor(w http.ResponseWriter, r *http.Request) (descriptor []byte, errs []ValidationError, ok bool) {
+	descriptor, err := v.ReadPayload(w, r)
+	if err != nil {
+		return nil, nil, false
+	}
+	_, errs = ParseXappConfigs(descriptor)
+	if hasErrors(errs) {
+		v.respondWithJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "invalid measurement descriptor", "details": errs})
+		return nil, errs, false
+	}
+	return descriptor, errs, true
+}
+
+// updatePltStore applies the change to the stored platform measurements
+func (v *VespaMgr) updatePltStore(change func(store map[string]json.RawMessage)) error {
+	v.pltMu.Lock()
+	defer v.pltMu.Unlock()
+
+	fname := app.Config.GetString("controls.pltFile")
+	store, err := readPltStore(fname)
+	if err != nil {
+		return err
+	}
+	change(store)
+
+	data, err := json.Marshal(store)
+	if err != nil {
+		return err
+	}
+	if err := storePltMeasurements(fname, data); err != nil {
+		return err
+	}
+
+	v.confMu.Lock()
+	v.pltFileCreated = len(store) > 0
+	v.confMu.Unlock()
+	return nil
+}
+
+// readPltStore reads the platform measurement descriptors of each component. A file
+// in the earlier format, containing a single descriptor, is read as the measurements
+// of the default component.
+func readPltStore(fname string) (map[string]json.RawMessage, error) {
+	store := make(map[string]json.RawMessage)
+	data, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("%s is not valid JSON", fname)
+	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] != '{' {
+		store[defaultPltComponent] = trimmed
+		return store, nil
+	}
+	if err := json.Unmarshal(data, &store); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// mergePltStore concatenates the measurement descriptors of all components
+func mergePltStore(store map[string]json.RawMessage) json.RawMessage {
+	merged := []json.RawMessage{}
+	for _, component := range sortedComponents(store) {
+		var entries []json.RawMessage
+		if err := json.Unmarshal(store[component], &entries); err == nil {
+			merged = append(merged, entries...)
+		}
+	}
+	data, _ := json.Marshal(merged)
+	return data
+}
+
+func sortedComponents(store map[string]json.RawMessage) []string {
+	var components []string
+	for component := range store {
+		components = append(components, component)
+	}
+	sort.Strings(components)
+	return components
+}
+
+// storePltMeasurements persists the platform measurement definitions, so that they
+// survive a restart if the file is on a persistent volume
+func storePltMeasurements(fname string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(fname, 0644, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// LoadPltMeasurements takes the platform measurement definitions stored earlier into use
+func (v *VespaMgr) LoadPltMeasurements() {
+	fname := app.Config.GetString("controls.pltFile")
+	store, err := readPltStore(fname)
+	if err != nil {
+		app.Logger.Error("Stored platform measurements ignored: %v", err)
+		return
+	}
+	if len(store) == 0 {
+		return
+	}
+
+	v.confMu.Lock()
+	v.pltFileCreated = true
+	v.confMu.Unlock()
+	app.Logger.Info("Platform measurements of %v loaded from %s", sortedComponents(store), fname)
+}
@@ -0,0 +1,161 @@
+/*
+ *  Copyright (c) 2020 AT&T Intellectual Property.
+ *  Copyright (c) 2020 Nokia.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  This source code is part of the near-RT RIC (RAN Intelligent Controller)
+ *  platform project (RICP).
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	app "gerrit.o-ran-sc.org/r/ric-plt/xapp-frame/pkg/xapp"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func measurementRequest(v *VespaMgr, method, path, body string) (int, []byte) {
+	req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+	req = mux.SetURLVars(req, map[string]string{"component": strings.TrimPrefix(path, "/ric/v1/measurements/")})
+	handler := v.HandleComponentMeasurements
+	if path == "/ric/v1/measurements" {
+		handler = v.HandleMeasurementList
+	}
+	response := executeRequest(req, http.HandlerFunc(handler))
+	return response.Code, response.Body.Bytes()
+}
+
+func TestComponentMeasurementsCRUD(t *testing.T) {
+	fname := app.Config.GetString("controls.pltFile")
+	os.Remove(fname)
+	defer os.Remove(fname)
+	defer os.Remove(fname + ".bak")
+	vespaMgr := NewVespaMgr()
+
+	e2term := `[` + xappConfigEntry("e2term", "e2term_counter") + `]`
+	e2mgr := `[` + xappConfigEntry("e2mgr", "e2mgr_counter") + `]`
+
+	code, _ := measurementRequest(vespaMgr, "GET", "/ric/v1/measurements/e2term", "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, body := measurementRequest(vespaMgr, "PUT", "/ric/v1/measurements/e2term", e2term)
+	assert.Equal(t, http.StatusOK, code, string(body))
+	code, body = measurementRequest(vespaMgr, "PUT", "/ric/v1/measurements/e2mgr", e2mgr)
+	assert.Equal(t, http.StatusOK, code, string(body))
+	assert.True(t, vespaMgr.pltFileCreated)
+
+	code, body = measurementRequest(vespaMgr, "GET", "/ric/v1/measurements/e2term", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.JSONEq(t, e2term, string(body))
+
+	code, body = measurementRequest(vespaMgr, "GET", "/ric/v1/measurements", "")
+	assert.Equal(t, http.StatusOK, code)
+	var list PltMeasurementList
+	assert.Nil(t, json.Unmarshal(body, &list))
+	assert.Equal(t, 2, len(list.Components))
+	var merged []json.RawMessage
+	assert.Nil(t, json.Unmarshal(list.Measurements, &merged))
+	assert.Equal(t, 2, len(merged))
+
+	code, _ = measurementRequest(vespaMgr, "DELETE", "/ric/v1/measurements/e2term", "")
+	assert.Equal(t, http.StatusNoContent, code)
+	code, _ = measurementRequest(vespaMgr, "DELETE", "/ric/v1/measurements/e2term", "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	store, err := readPltStore(fname)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"e2mgr"}, sortedComponents(store))
+
+	code, _ = measurementRequest(vespaMgr, "DELETE", "/ric/v1/measurements/e2mgr", "")
+	assert.Equal(t, http.StatusNoContent, code)
+	assert.False(t, vespaMgr.pltFileCreated)
+}
+
+func TestComponentMeasurementsAreValidated(t *testing.T) {
+	fname := app.Config.GetString("controls.pltFile")
+	os.Remove(fname)
+	defer os.Remove(fname)
+	vespaMgr := NewVespaMgr()
+
+	code, body := measurementRequest(vespaMgr, "PUT", "/ric/v1/measurements/e2term",
+		`[{"metadata": {"xappName": "e2term"}, "config": {"measurements": [{"moId": "SEP"}]}}]`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	var response struct {
+		Error   string            `json:"error"`
+		Details []ValidationError `json:"details"`
+	}
+	assert.Nil(t, json.Unmarshal(body, &response))
+	assert.Equal(t, "invalid measurement descriptor", response.Error)
+	assert.NotEmpty(t, response.Details)
+
+	code, _ = measurementRequest(vespaMgr, "PUT", "/ric/v1/measurements/e2term", `{"not": "a list"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = measurementRequest(vespaMgr, "PUT", "/ric/v1/measurements/", `[]`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	_, err := os.Stat(fname)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPostedMeasurementsAreValidated(t *testing.T) {
+	fname := app.Config.GetString("controls.pltFile")
+	os.Remove(fname)
+	defer os.Remove(fname)
+	vespaMgr := NewVespaMgr()
+
+	for _, body := range []string{
+		`[{"metadata": {"xappName": "e2term"}, "config": {"measurements": [{"moId": "SEP"}]}}]`,
+		`{"not": "a list"}`,
+	} {
+		req, _ := http.NewRequest("POST", "/ric/v1/measurements", bytes.NewBufferString(body))
+		response := executeRequest(req, http.HandlerFunc(vespaMgr.HandleMeasurements))
+		assert.Equal(t, http.StatusBadRequest, response.Code, body)
+		var errorResponse struct {
+			Error string `json:"error"`
+		}
+		assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &errorResponse))
+		assert.Equal(t, "invalid measurement descriptor", errorResponse.Error)
+	}
+
+	_, err := os.Stat(fname)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestLegacyPltFileIsDefaultComponent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "plt")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	fname := dir + "/plt.json"
+
+	legacy := `[` + xappConfigEntry("e2term", "e2term_counter") + `]`
+	assert.Nil(t, ioutil.WriteFile(fname, []byte(legacy), 0644))
+	store, err := readPltStore(fname)
+	assert.Nil(t, err)
+	assert.JSONEq(t, legacy, string(store[defaultPltComponent]))
+	assert.JSONEq(t, legacy, string(mergePltStore(store)))
+
+	assert.Nil(t, ioutil.WriteFile(fname, []byte(`{"broken`), 0644))
+	_, err = readPltStore(fname)
+	assert.NotNil(t, err)
+}
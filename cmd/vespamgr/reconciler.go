@@ -0,0 +1,85 @@
+/*
+ *  Copyright (c) 2020 AT&T Intellectual Property.
+ *  Copyright (c) 2020 Nokia.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  This source code is part of the near-RT RIC (RAN Intelligent Controller)
+ *  platform project (RICP).
+ *
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	app "gerrit.o-ran-sc.org/r/ric-plt/xapp-frame/pkg/xapp"
+)
+
+const (
+	counterReconciliations = "Reconciliations"
+	counterDrifts          = "ReconciliationDrifts"
+)
+
+var (
+	reconcilerCountersOnce sync.Once
+	reconcilerCounters     map[string]app.Counter
+)
+
+// getReconcilerCounters registers the reconciler metrics on first use. The
+// metrics can be registered only once per process.
+func getReconcilerCounters() map[string]app.Counter {
+	reconcilerCountersOnce.Do(func() {
+		reconcilerCounters = app.Metric.RegisterCounterGroup([]app.CounterOpts{
+			{Name: counterReconciliations, Help: "The number of reconciliations against appmgr"},
+			{Name: counterDrifts, Help: "The number of reconciliations that found the VES agent configuration out of date"},
+		}, "vespamgr")
+	})
+	return reconcilerCounters
+}
+
+// Reconcile fetches the xApp configurations from appmgr and applies them if the
+// VES agent configuration has drifted from them, e.g. because a notification was
+// lost. It returns true if a drift was found.
+func (v *VespaMgr) Reconcile() (bool, error) {
+	counters := getReconcilerCounters()
+	counters[counterReconciliations].Inc()
+
+	drifted, err := v.updateVesagentConfig(false)
+	if err != nil {
+		app.Logger.Warn("Reconciliation failed: %v", err)
+		return false, err
+	}
+	if drifted {
+		counters[counterDrifts].Inc()
+		app.Logger.Warn("VES agent configuration was out of date, updated")
+	}
+	return drifted, nil
+}
+
+// RunReconciler reconciles the VES agent configuration periodically
+func (v *VespaMgr) RunReconciler(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			v.Reconcile()
+		case <-v.ctx.Done():
+			return
+		}
+	}
+}
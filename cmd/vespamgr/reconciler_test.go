@@ -0,0 +1,75 @@
+/*
+ *  Copyright (c) 2020 AT&T Intellectual Property.
+ *  Copyright (c) 2020 Nokia.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  This source code is part of the near-RT RIC (RAN Intelligent Controller)
+ *  platform project (RICP).
+ *
+ */
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconcileAppliesDriftOnly(t *testing.T) {
+	xappConfig, err := ioutil.ReadFile("../../test/xApp_config_test_output.json")
+	assert.Nil(t, err)
+
+	var served atomic.Value
+	served.Store([]byte(`[]`))
+	testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Add("Content-Type", "application/json")
+		res.Write(served.Load().([]byte))
+	}))
+	defer testServer.Close()
+
+	vespaMgr := NewVespaMgr()
+	vespaMgr.appmgrHost = testServer.URL
+
+	drifted, err := vespaMgr.Reconcile()
+	assert.Nil(t, err)
+	assert.True(t, drifted)
+
+	drifted, err = vespaMgr.Reconcile()
+	assert.Nil(t, err)
+	assert.False(t, drifted)
+
+	served.Store(xappConfig)
+	drifted, err = vespaMgr.Reconcile()
+	assert.Nil(t, err)
+	assert.True(t, drifted)
+	assert.Equal(t, xappConfig, vespaMgr.xappConf)
+}
+
+func TestReconcileKeepsConfigWhenAppmgrFails(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {}))
+	defer testServer.Close()
+
+	vespaMgr := NewVespaMgr()
+	vespaMgr.appmgrHost = testServer.URL
+	vespaMgr.xappConf = []byte(`[]`)
+
+	drifted, err := vespaMgr.Reconcile()
+	assert.NotNil(t, err)
+	assert.False(t, drifted)
+	assert.Equal(t, []byte(`[]`), vespaMgr.xappConf)
+}
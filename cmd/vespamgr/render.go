@@ -0,0 +1,185 @@
+/*
+ *  Copyright (c) 2020 AT&T Intellectual Property.
+ *  Copyright (c) 2020 Nokia.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  This source code is part of the near-RT RIC (RAN Intelligent Controller)
+ *  platform project (RICP).
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	app "gerrit.o-ran-sc.org/r/ric-plt/xapp-frame/pkg/xapp"
+	"gopkg.in/yaml.v2"
+)
+
+// fileList is a command line flag which can be given more than once
+type fileList []string
+
+func (l *fileList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *fileList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Render writes the VES agent configuration for the given descriptor files, without
+// RMR, appmgr or the xApp framework runtime, so that the configuration can be
+// generated and compared in CI. It returns the exit status of the command.
+//
+//	vespamgr render --descriptor xapp.json --plt plt-counter.json --collector collector.yaml
+func Render(args []string, stdout, stderr io.Writer) int {
+	var descriptors, plts fileList
+	v := NewVespaMgr()
+	flags := flag.NewFlagSet("render", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Var(&descriptors, "descriptor", "xApp descriptor file, or file with a list of descriptors (repeatable)")
+	flags.Var(&plts, "plt", "platform measurement descriptor file (repeatable), controls.pltCounterFile if not given")
+	collectorFile := flags.String("collector", "", "YAML or JSON file with the collector settings, read from the vespamgr configuration if not given")
+	caCertFile := flags.String("ca-cert", app.Config.GetString("controls.collector.caCertFile"), "CA bundle of the collector connection, used without --collector")
+	output := flags.String("output", "-", "file to write the VES agent configuration to, - for stdout")
+	entityID := flags.String("reporting-entity-id", defaultReportingEntityID, "reporting entity ID of the events")
+	vnfName := flags.String("vnf-name", v.getVNFName(), "VNF name of the events")
+	nfNamingCode := flags.String("nf-naming-code", v.getNFNamingCode(), "NF naming code of the events")
+	selector := configuredSelector()
+	flags.StringVar(&selector.XApp, "xapp-selector", selector.XApp, "label selector restricting the xApp metrics to the owning xApp, %s is replaced with the xApp name")
+	flags.StringVar(&selector.Namespace, "namespace-selector", selector.Namespace, "label selector restricting the xApp metrics to the namespace of the xApp, %s is replaced with the namespace")
+	strict := flags.Bool("strict", false, "fail if parts of the descriptors were rejected")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	// The logs of the xApp framework would be mixed with the configuration on stdout
+	app.Logger.SetLevel(0)
+
+	xappConfig, err := readDescriptorFiles(descriptors)
+	if err != nil {
+		fmt.Fprintf(stderr, "render: %v\n", err)
+		return 1
+	}
+	if len(plts) == 0 {
+		if pltCounterFile := app.Config.GetString("controls.pltCounterFile"); pltCounterFile != "" {
+			plts = append(plts, pltCounterFile)
+		} else {
+			fmt.Fprintf(stderr, "render: no --plt given and controls.pltCounterFile not set, the platform counters are left out\n")
+		}
+	}
+	var pltSources []descriptorSource
+	for _, fname := range plts {
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			fmt.Fprintf(stderr, "render: %v\n", err)
+			return 1
+		}
+		pltSources = append(pltSources, descriptorSource{name: fname, descriptor: data})
+	}
+
+	if *collectorFile == "" {
+		collectorTLS, err := loadCollectorTLS(*caCertFile)
+		if err != nil {
+			fmt.Fprintf(stderr, "render: %v\n", err)
+			return 1
+		}
+		v.setCollectorTLS(collectorTLS, nil)
+	}
+
+	vespaconf, _, errs := v.BuildConfig(xappConfig, pltSources, selector)
+	vespaconf.Event.ReportingEntityID = *entityID
+	vespaconf.Event.VNFName = *vnfName
+	vespaconf.Event.NfNamingCode = *nfNamingCode
+	if *collectorFile != "" {
+		collectors, err := readCollectorSettings(*collectorFile)
+		if err != nil {
+			fmt.Fprintf(stderr, "render: %v\n", err)
+			return 1
+		}
+		vespaconf.PrimaryCollector = collectors.PrimaryCollector
+		vespaconf.BackupCollector = collectors.BackupCollector
+		vespaconf.CaCert = collectors.CaCert
+	}
+
+	data, err := encodeConfig(&vespaconf)
+	if err != nil {
+		fmt.Fprintf(stderr, "render: unable to encode the VES agent configuration: %v\n", err)
+		return 1
+	}
+
+	for _, e := range errs {
+		fmt.Fprintf(stderr, "%s\n", e.Error())
+	}
+	if *strict && hasErrors(errs) {
+		return 1
+	}
+
+	if *output == "-" {
+		_, err = stdout.Write(data)
+	} else {
+		err = ioutil.WriteFile(*output, data, 0600)
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "render: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// readDescriptorFiles joins the xApp descriptors of the files into a list, like
+// the one returned by appmgr
+func readDescriptorFiles(fnames []string) ([]byte, error) {
+	entries := []json.RawMessage{}
+	for _, fname := range fnames {
+		data, err := ioutil.ReadFile(fname)
+		if err != nil {
+			return nil, err
+		}
+		data = bytes.TrimSpace(data)
+		if len(data) > 0 && data[0] == '{' {
+			entries = append(entries, data)
+			continue
+		}
+
+		var list []json.RawMessage
+		if err := json.Unmarshal(data, &list); err != nil {
+			return nil, fmt.Errorf("%s: not an xApp descriptor or a list of them: %v", fname, err)
+		}
+		entries = append(entries, list...)
+	}
+	return json.Marshal(entries)
+}
+
+// readCollectorSettings reads the collector settings in the format of the VES agent
+// configuration. Only primaryCollector, backupCollector and caCert are taken from it.
+func readCollectorSettings(fname string) (*VESAgentConfiguration, error) {
+	data, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var settings VESAgentConfiguration
+	if err := yaml.UnmarshalStrict(data, &settings); err != nil {
+		return nil, fmt.Errorf("%s: %v", fname, err)
+	}
+	return &settings, nil
+}
@@ -0,0 +1,158 @@
+/*
+ *  Copyright (c) 2020 AT&T Intellectual Property.
+ *  Copyright (c) 2020 Nokia.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  This source code is part of the near-RT RIC (RAN Intelligent Controller)
+ *  platform project (RICP).
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v2"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files of the render tests")
+
+const renderGoldenFile = "../../test/ves-agent_render_golden.yaml"
+
+func renderArgs(extra ...string) []string {
+	args := []string{
+		"--descriptor", "../../test/xApp_config_test_output.json",
+		"--plt", "../../test/plt-counter_render_test.json",
+		"--collector", "../../test/collector_render_test.yaml",
+		"--xapp-selector", `kubernetes_name=~"service-ricxapp-%s-(http|rmr)"`,
+	}
+	return append(args, extra...)
+}
+
+func TestRenderGolden(t *testing.T) {
+	os.Unsetenv("VESMGR_VNFNAME")
+	os.Unsetenv("VESMGR_NFNAMINGCODE")
+
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, 0, Render(renderArgs(), &stdout, &stderr))
+	assert.Empty(t, stderr.String())
+
+	if *updateGolden {
+		assert.Nil(t, ioutil.WriteFile(renderGoldenFile, stdout.Bytes(), 0644))
+	}
+	golden, err := ioutil.ReadFile(renderGoldenFile)
+	assert.Nil(t, err)
+	assert.Equal(t, string(golden), stdout.String())
+
+	// Rendering again gives the same configuration
+	var again bytes.Buffer
+	assert.Equal(t, 0, Render(renderArgs(), &again, &stderr))
+	assert.Equal(t, stdout.String(), again.String())
+}
+
+func TestRenderToFile(t *testing.T) {
+	fname := fmt.Sprintf("%s/ves-agent-render-%d.yaml", os.TempDir(), os.Getpid())
+	defer os.Remove(fname)
+
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, 0, Render(renderArgs("--output", fname, "--reporting-entity-id", "test-id",
+		"--vnf-name", "test-vnf", "--nf-naming-code", "test-code"), &stdout, &stderr))
+	assert.Empty(t, stdout.String())
+
+	data, err := ioutil.ReadFile(fname)
+	assert.Nil(t, err)
+	var vespaconf VESAgentConfiguration
+	assert.Nil(t, yaml.Unmarshal(data, &vespaconf))
+	assert.Equal(t, "test-id", vespaconf.Event.ReportingEntityID)
+	assert.Equal(t, "test-vnf", vespaconf.Event.VNFName)
+	assert.Equal(t, "test-code", vespaconf.Event.NfNamingCode)
+	assert.Equal(t, "ves-collector-1", vespaconf.PrimaryCollector.FQDN)
+	assert.Equal(t, "ves-collector-2", vespaconf.BackupCollector.FQDN)
+	assert.Equal(t, 5, len(vespaconf.Measurement.Prometheus.Rules.Metrics))
+}
+
+func TestRenderWithoutPlatformMeasurements(t *testing.T) {
+	args := []string{"--descriptor", "../../test/xApp_config_test_output.json",
+		"--collector", "../../test/collector_render_test.yaml"}
+
+	// The UT configuration has no controls.pltCounterFile to fall back to
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, 0, Render(args, &stdout, &stderr))
+	assert.Contains(t, stderr.String(), "controls.pltCounterFile not set")
+
+	var vespaconf VESAgentConfiguration
+	assert.Nil(t, yaml.Unmarshal(stdout.Bytes(), &vespaconf))
+	assert.NotEmpty(t, vespaconf.Measurement.Prometheus.Rules.Metrics)
+	for _, rule := range vespaconf.Measurement.Prometheus.Rules.Metrics {
+		assert.NotContains(t, rule.Expr, "E2TAlpha")
+	}
+}
+
+func TestRenderCACertWithoutCollector(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vespamgr")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile, _ := writeTestCertificate(t, dir, "collector-ca", time.Now().Add(365*24*time.Hour))
+	cert, err := ioutil.ReadFile(certFile)
+	assert.Nil(t, err)
+
+	var stdout, stderr bytes.Buffer
+	args := []string{"--descriptor", "../../test/xApp_config_test_output.json", "--ca-cert", certFile}
+	assert.Equal(t, 0, Render(args, &stdout, &stderr))
+	var vespaconf VESAgentConfiguration
+	assert.Nil(t, yaml.Unmarshal(stdout.Bytes(), &vespaconf))
+	assert.Equal(t, string(cert), vespaconf.CaCert)
+
+	stdout.Reset()
+	stderr.Reset()
+	invalid := filepath.Join(dir, "invalid.crt")
+	assert.Nil(t, ioutil.WriteFile(invalid, []byte("not a certificate"), 0644))
+	args = []string{"--descriptor", "../../test/xApp_config_test_output.json", "--ca-cert", invalid}
+	assert.Equal(t, 1, Render(args, &stdout, &stderr))
+	assert.Empty(t, stdout.String())
+	assert.Contains(t, stderr.String(), "render: ")
+}
+
+func TestRenderRejectedMeasurements(t *testing.T) {
+	args := []string{"--descriptor", "../../test/inValidMeasurements_xApp_config_test_output.json",
+		"--collector", "../../test/collector_render_test.yaml"}
+
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, 0, Render(args, &stdout, &stderr))
+	assert.NotEmpty(t, stdout.String())
+	assert.Contains(t, stderr.String(), "error: ")
+
+	stdout.Reset()
+	stderr.Reset()
+	assert.Equal(t, 1, Render(append(args, "--strict"), &stdout, &stderr))
+	assert.Empty(t, stdout.String())
+	assert.Contains(t, stderr.String(), "error: ")
+}
+
+func TestRenderInvalidArguments(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	assert.Equal(t, 2, Render([]string{"--unknown"}, &stdout, &stderr))
+	assert.Equal(t, 1, Render([]string{"--descriptor", "/nonexistent/descriptor.json"}, &stdout, &stderr))
+	assert.Equal(t, 1, Render([]string{"--plt", "/nonexistent/plt.json"}, &stdout, &stderr))
+	assert.Equal(t, 1, Render([]string{"--collector", "../../test/xApp_config_test_output.json"}, &stdout, &stderr))
+	assert.Empty(t, stdout.String())
+}
@@ -0,0 +1,104 @@
+/*
+ *  Copyright (c) 2020 AT&T Intellectual Property.
+ *  Copyright (c) 2020 Nokia.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  This source code is part of the near-RT RIC (RAN Intelligent Controller)
+ *  platform project (RICP).
+ *
+ */
+
+package main
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	app "gerrit.o-ran-sc.org/r/ric-plt/xapp-frame/pkg/xapp"
+)
+
+// RetryPolicy tells how a failed request is retried
+type RetryPolicy struct {
+	MaxAttempts int
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	Timeout     time.Duration // Timeout of a single attempt
+}
+
+// Backoff returns the delay before the given retry. The delay grows exponentially
+// from MinBackoff up to MaxBackoff, and is randomized to between half and full
+// length, so that the clients of a restarted server do not retry all at once.
+func (p RetryPolicy) Backoff(retry int) time.Duration {
+	delay := exponentialBackoff(p.MinBackoff, p.MaxBackoff, retry)
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Do calls attempt until it succeeds or MaxAttempts attempts have failed, and
+// returns the error of the last attempt. Each attempt gets a context which expires
+// after Timeout. The retries are given up when ctx is cancelled.
+func (p RetryPolicy) Do(ctx context.Context, name string, attempt func(ctx context.Context) error) error {
+	maxAttempts := p.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 1
+	}
+
+	var err error
+	for i := 1; ; i++ {
+		attemptCtx, cancel := p.withTimeout(ctx)
+		err = attempt(attemptCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if i >= maxAttempts {
+			app.Logger.Error("%s failed after %d attempts: %v", name, i, err)
+			return err
+		}
+
+		delay := p.Backoff(i)
+		app.Logger.Warn("%s failed: %v, retrying in %v [%d/%d]", name, err, delay, i, maxAttempts)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (p RetryPolicy) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, p.Timeout)
+}
+
+// exponentialBackoff returns the delay after the given number of failures, doubling
+// from minDelay up to maxDelay
+func exponentialBackoff(minDelay, maxDelay time.Duration, failures int) time.Duration {
+	delay := minDelay
+	for i := 1; i < failures && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
@@ -0,0 +1,129 @@
+/*
+ *  Copyright (c) 2020 AT&T Intellectual Property.
+ *  Copyright (c) 2020 Nokia.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  This source code is part of the near-RT RIC (RAN Intelligent Controller)
+ *  platform project (RICP).
+ *
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExponentialBackoff(t *testing.T) {
+	assert.Equal(t, time.Second, exponentialBackoff(time.Second, 10*time.Second, 1))
+	assert.Equal(t, 2*time.Second, exponentialBackoff(time.Second, 10*time.Second, 2))
+	assert.Equal(t, 8*time.Second, exponentialBackoff(time.Second, 10*time.Second, 4))
+	assert.Equal(t, 10*time.Second, exponentialBackoff(time.Second, 10*time.Second, 10))
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := RetryPolicy{MinBackoff: time.Second, MaxBackoff: 10 * time.Second}
+	for i := 0; i < 100; i++ {
+		for retry, max := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 4: 8 * time.Second, 10: 10 * time.Second} {
+			delay := p.Backoff(retry)
+			assert.True(t, delay >= max/2 && delay <= max, "retry %d: %v", retry, delay)
+		}
+	}
+	assert.Equal(t, time.Duration(0), RetryPolicy{}.Backoff(1))
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 3, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+
+	attempts := 0
+	err := p.Do(context.Background(), "test", func(ctx context.Context) error {
+		attempts++
+		return fmt.Errorf("failure %d", attempts)
+	})
+	assert.Equal(t, "failure 3", err.Error())
+	assert.Equal(t, 3, attempts)
+
+	attempts = 0
+	err = p.Do(context.Background(), "test", func(ctx context.Context) error {
+		attempts++
+		if attempts < 2 {
+			return fmt.Errorf("failure")
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, attempts)
+}
+
+func TestRetryPolicyDoIsCancellable(t *testing.T) {
+	p := RetryPolicy{MaxAttempts: 100, MinBackoff: time.Hour, MaxBackoff: time.Hour}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	err := p.Do(ctx, "test", func(ctx context.Context) error { return fmt.Errorf("failure") })
+	assert.Equal(t, context.Canceled, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestQueryXappConfTimesOut(t *testing.T) {
+	release := make(chan struct{})
+	testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		<-release
+	}))
+	defer testServer.Close()
+	defer close(release)
+
+	vespaMgr := NewVespaMgr()
+	vespaMgr.appmgrRetry = 2
+	vespaMgr.retryBackoff = time.Millisecond
+	vespaMgr.requestTimeout = 50 * time.Millisecond
+
+	start := time.Now()
+	_, err := vespaMgr.QueryXappConf(testServer.URL)
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestShutdownCancelsAppmgrRetries(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer testServer.Close()
+
+	vespaMgr := NewVespaMgr()
+	vespaMgr.appmgrRetry = 1000
+	vespaMgr.retryBackoff = time.Hour
+	vespaMgr.retryMaxBackoff = time.Hour
+
+	done := make(chan struct{})
+	go func() {
+		vespaMgr.subscribeXappNotif(testServer.URL)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	vespaMgr.Shutdown()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("subscription retries not cancelled")
+	}
+}
@@ -21,37 +21,193 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"syscall"
+	"time"
+
+	app "gerrit.o-ran-sc.org/r/ric-plt/xapp-frame/pkg/xapp"
 )
 
 type CommandRunner struct {
-	exe  string
-	args []string
-	cmd  *exec.Cmd
+	exe    string
+	args   []string
+	cmd    *exec.Cmd
+	done   chan struct{}
+	output *OutputLog
+}
+
+// SetOutput makes the runner capture the output of the process into the given log
+func (r *CommandRunner) SetOutput(output *OutputLog) {
+	r.output = output
 }
 
 func (r *CommandRunner) Run(result chan error) {
 	r.cmd = exec.Command(r.exe, r.args...)
 	r.cmd.Stdout = os.Stdout
 	r.cmd.Stderr = os.Stderr
+
+	var stdout, stderr *lineWriter
+	if r.output != nil {
+		stdout = &lineWriter{log: r.output, tag: r.tag, out: os.Stdout}
+		stderr = &lineWriter{log: r.output, tag: r.tag, out: os.Stderr}
+		r.cmd.Stdout = stdout
+		r.cmd.Stderr = stderr
+	}
+
+	r.done = make(chan struct{})
 	err := r.cmd.Start()
 	go func() {
-		if err != nil {
-			result <- err
-		} else {
-			result <- r.cmd.Wait()
+		if err == nil {
+			err = r.cmd.Wait()
 		}
+		if r.output != nil {
+			stdout.flush()
+			stderr.flush()
+		}
+		close(r.done)
+		result <- err
 	}()
 }
 
+// tag identifies the output lines of the process, e.g. "ves-agent[42]"
+func (r *CommandRunner) tag() string {
+	return fmt.Sprintf("%s[%d]", filepath.Base(r.exe), r.cmd.Process.Pid)
+}
+
 func (r *CommandRunner) Kill() error {
-	if r.cmd != nil {
+	if r.cmd != nil && r.cmd.Process != nil {
 		return r.cmd.Process.Kill()
 	}
 	return nil
 }
 
+// Terminate sends SIGTERM to the process and waits for it to exit. If the process
+// is still running after the grace period, it is killed. The returned flag tells
+// whether the process had to be killed.
+func (r *CommandRunner) Terminate(grace time.Duration) (bool, error) {
+	if r.cmd == nil || r.cmd.Process == nil {
+		return false, nil
+	}
+
+	if err := r.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		select {
+		case <-r.done:
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	select {
+	case <-r.done:
+		return false, nil
+	case <-time.After(grace):
+	}
+
+	if err := r.cmd.Process.Kill(); err != nil {
+		select {
+		case <-r.done:
+			return false, nil
+		default:
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// OutputLog collects the output of child processes line by line. Each line is
+// tagged with the name and PID of the process, passed on either to the manager
+// log or to the original stream, and the most recent lines are kept in memory.
+type OutputLog struct {
+	mu        sync.Mutex
+	lines     []string
+	next      int
+	full      bool
+	useLogger bool
+}
+
+func NewOutputLog(size int, useLogger bool) *OutputLog {
+	return &OutputLog{lines: make([]string, size), useLogger: useLogger}
+}
+
+// Lines returns the buffered lines, oldest first
+func (o *OutputLog) Lines() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if !o.full {
+		return append([]string{}, o.lines[:o.next]...)
+	}
+	return append(append([]string{}, o.lines[o.next:]...), o.lines[:o.next]...)
+}
+
+var logLevelRe = regexp.MustCompile(`level=(\w+)`)
+
+func (o *OutputLog) add(tag, line string, out io.Writer) {
+	if len(o.lines) > 0 {
+		o.mu.Lock()
+		o.lines[o.next] = fmt.Sprintf("%s: %s", tag, line)
+		o.next = (o.next + 1) % len(o.lines)
+		o.full = o.full || o.next == 0
+		o.mu.Unlock()
+	}
+
+	if !o.useLogger {
+		fmt.Fprintf(out, "%s: %s\n", tag, line)
+		return
+	}
+
+	level := ""
+	if m := logLevelRe.FindStringSubmatch(line); m != nil {
+		level = m[1]
+	}
+	switch level {
+	case "panic", "fatal", "error":
+		app.Logger.Error("%s: %s", tag, line)
+	case "warning", "warn":
+		app.Logger.Warn("%s: %s", tag, line)
+	case "debug", "trace":
+		app.Logger.Debug("%s: %s", tag, line)
+	default:
+		app.Logger.Info("%s: %s", tag, line)
+	}
+}
+
+// lineWriter splits the output stream of a process into lines for an OutputLog
+type lineWriter struct {
+	log *OutputLog
+	tag func() string
+	out io.Writer
+	buf []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.log.add(w.tag(), string(bytes.TrimRight(w.buf[:i], "\r")), w.out)
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+func (w *lineWriter) flush() {
+	if len(w.buf) > 0 {
+		w.log.add(w.tag(), string(w.buf), w.out)
+		w.buf = nil
+	}
+}
+
 func NewCommandRunner(exe string, arg ...string) *CommandRunner {
 	r := &CommandRunner{exe: exe, args: arg}
 	return r
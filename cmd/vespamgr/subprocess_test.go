@@ -21,7 +21,9 @@
 package main
 
 import (
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -42,6 +44,27 @@ func TestProcessKill(t *testing.T) {
 	<-ch // wait and seee that kills is actually done
 }
 
+func TestProcessTerminate(t *testing.T) {
+	r := NewCommandRunner("sleep", "20")
+	ch := make(chan error)
+	r.Run(ch)
+	killed, err := r.Terminate(time.Second)
+	assert.Nil(t, err)
+	assert.False(t, killed)
+	<-ch
+}
+
+func TestProcessTerminateKillsAfterGracePeriod(t *testing.T) {
+	r := NewCommandRunner("sh", "-c", "trap '' TERM; exec sleep 20")
+	ch := make(chan error)
+	r.Run(ch)
+	time.Sleep(100 * time.Millisecond)
+	killed, err := r.Terminate(100 * time.Millisecond)
+	assert.Nil(t, err)
+	assert.True(t, killed)
+	<-ch
+}
+
 func TestProcessRunningFails(t *testing.T) {
 	r := NewCommandRunner("foobarbaz")
 	ch := make(chan error)
@@ -49,3 +72,28 @@ func TestProcessRunningFails(t *testing.T) {
 	err := <-ch
 	assert.NotNil(t, err)
 }
+
+func TestProcessOutputIsCaptured(t *testing.T) {
+	output := NewOutputLog(10, true)
+	r := NewCommandRunner("sh", "-c", "echo 'level=info msg=one'; echo two >&2; printf three")
+	r.SetOutput(output)
+	ch := make(chan error)
+	r.Run(ch)
+	assert.Nil(t, <-ch)
+
+	lines := output.Lines()
+	assert.Len(t, lines, 3)
+	for _, line := range lines {
+		assert.True(t, strings.HasPrefix(line, "sh["), line)
+	}
+	assert.Contains(t, strings.Join(lines, "\n"), "two")
+	assert.True(t, strings.HasSuffix(lines[2], ": three"))
+}
+
+func TestOutputLogKeepsLastLines(t *testing.T) {
+	output := NewOutputLog(3, true)
+	for _, line := range []string{"1", "2", "3", "4", "5"} {
+		output.add("tag", line, nil)
+	}
+	assert.Equal(t, []string{"tag: 3", "tag: 4", "tag: 5"}, output.Lines())
+}
@@ -0,0 +1,211 @@
+/*
+ *  Copyright (c) 2020 AT&T Intellectual Property.
+ *  Copyright (c) 2020 Nokia.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  This source code is part of the near-RT RIC (RAN Intelligent Controller)
+ *  platform project (RICP).
+ *
+ */
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	app "gerrit.o-ran-sc.org/r/ric-plt/xapp-frame/pkg/xapp"
+)
+
+// A process which stays up at least this long is considered healthy again,
+// and its crash counter is reset.
+const supervisorStableRun = time.Minute
+
+// StopResult tells how a supervised process was stopped
+type StopResult string
+
+const (
+	StopNotRunning StopResult = "not running"
+	StopGraceful   StopResult = "terminated"
+	StopKilled     StopResult = "killed"
+)
+
+// SupervisorStatus is a snapshot of the state of a supervised process
+type SupervisorStatus struct {
+	Running  bool      `json:"running"`
+	GaveUp   bool      `json:"gaveUp"`
+	Restarts int       `json:"restarts"`
+	Failures int       `json:"failures"`
+	LastExit string    `json:"lastExit,omitempty"`
+	Started  time.Time `json:"started,omitempty"`
+}
+
+// Supervisor keeps a child process running. When the process exits on its own
+// it is restarted with exponential backoff, until it has crashed maxRestarts
+// times in a row.
+type Supervisor struct {
+	name        string
+	newRunner   func() *CommandRunner
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	maxRestarts int
+	stopTimeout time.Duration
+
+	mu       sync.Mutex
+	runner   *CommandRunner
+	done     chan struct{}
+	running  bool
+	stopped  bool
+	gaveUp   bool
+	restarts int
+	failures int
+	lastExit string
+	started  time.Time
+}
+
+func NewSupervisor(name string, newRunner func() *CommandRunner, minBackoff, maxBackoff time.Duration, maxRestarts int, stopTimeout time.Duration) *Supervisor {
+	return &Supervisor{
+		name:        name,
+		newRunner:   newRunner,
+		minBackoff:  minBackoff,
+		maxBackoff:  maxBackoff,
+		maxRestarts: maxRestarts,
+		stopTimeout: stopTimeout,
+	}
+}
+
+// Start launches the process, clearing any earlier crash-loop state. Nothing is
+// done if the process is already running.
+func (s *Supervisor) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running {
+		app.Logger.Info("%s already running", s.name)
+		return
+	}
+	s.stopped = false
+	s.gaveUp = false
+	s.failures = 0
+	s.launch()
+}
+
+// Stop asks the process to terminate, giving it stopTimeout to flush its data
+// before it is killed, and waits for it to exit. The process is not restarted.
+func (s *Supervisor) Stop() (StopResult, error) {
+	s.mu.Lock()
+	s.stopped = true
+	runner, done, running := s.runner, s.done, s.running
+	s.mu.Unlock()
+
+	if !running {
+		return StopNotRunning, nil
+	}
+
+	start := time.Now()
+	killed, err := runner.Terminate(s.stopTimeout)
+	if err != nil {
+		app.Logger.Error("Couldn't stop %s: %s", s.name, err.Error())
+		return StopNotRunning, err
+	}
+	<-done
+
+	if killed {
+		app.Logger.Warn("%s did not exit within %v, killed", s.name, s.stopTimeout)
+		return StopKilled, nil
+	}
+	app.Logger.Info("%s terminated in %v", s.name, time.Since(start))
+	return StopGraceful, nil
+}
+
+// IsDown tells whether the process has been started but is not running now
+func (s *Supervisor) IsDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.runner != nil && !s.running
+}
+
+func (s *Supervisor) Status() SupervisorStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return SupervisorStatus{
+		Running:  s.running,
+		GaveUp:   s.gaveUp,
+		Restarts: s.restarts,
+		Failures: s.failures,
+		LastExit: s.lastExit,
+		Started:  s.started,
+	}
+}
+
+// launch must be called with s.mu held
+func (s *Supervisor) launch() {
+	result := make(chan error)
+	done := make(chan struct{})
+
+	s.runner = s.newRunner()
+	s.done = done
+	s.running = true
+	s.started = time.Now()
+	s.runner.Run(result)
+
+	go s.watch(s.runner, result, done)
+}
+
+func (s *Supervisor) watch(runner *CommandRunner, result chan error, done chan struct{}) {
+	err := <-result
+
+	s.mu.Lock()
+	s.running = false
+	s.lastExit = exitReason(err)
+	close(done)
+
+	if s.stopped || s.runner != runner {
+		s.mu.Unlock()
+		return
+	}
+
+	if time.Since(s.started) >= supervisorStableRun {
+		s.failures = 0
+	}
+	s.failures++
+	if s.maxRestarts > 0 && s.failures > s.maxRestarts {
+		s.gaveUp = true
+		s.mu.Unlock()
+		app.Logger.Error("%s keeps crashing (%d times in a row), giving up: %s", s.name, s.maxRestarts, s.lastExit)
+		return
+	}
+	delay := exponentialBackoff(s.minBackoff, s.maxBackoff, s.failures)
+	s.mu.Unlock()
+
+	app.Logger.Warn("%s exited unexpectedly: %s, restarting in %v", s.name, exitReason(err), delay)
+	time.Sleep(delay)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped || s.runner != runner {
+		return
+	}
+	s.restarts++
+	s.launch()
+}
+
+func exitReason(err error) string {
+	if err == nil {
+		return "exited with status 0"
+	}
+	return err.Error()
+}
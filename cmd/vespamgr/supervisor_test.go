@@ -0,0 +1,102 @@
+/*
+ *  Copyright (c) 2020 AT&T Intellectual Property.
+ *  Copyright (c) 2020 Nokia.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  This source code is part of the near-RT RIC (RAN Intelligent Controller)
+ *  platform project (RICP).
+ *
+ */
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSupervisorRestartsCrashedProcess(t *testing.T) {
+	s := NewSupervisor("test", func() *CommandRunner { return NewCommandRunner("sh", "-c", "exit 3") },
+		10*time.Millisecond, 20*time.Millisecond, 0, time.Second)
+	s.Start()
+
+	assert.Eventually(t, func() bool { return s.Status().Restarts >= 2 }, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, s.Status().LastExit, "exit status 3")
+	_, err := s.Stop()
+	assert.Nil(t, err)
+}
+
+func TestSupervisorGivesUpOnCrashLoop(t *testing.T) {
+	s := NewSupervisor("test", func() *CommandRunner { return NewCommandRunner("foobarbaz") },
+		time.Millisecond, time.Millisecond, 3, time.Second)
+	s.Start()
+
+	assert.Eventually(t, func() bool { return s.Status().GaveUp }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 3, s.Status().Restarts)
+	assert.True(t, s.IsDown())
+}
+
+func TestSupervisorStopDoesNotRestart(t *testing.T) {
+	s := NewSupervisor("test", func() *CommandRunner { return NewCommandRunner("sleep", "20") },
+		time.Millisecond, time.Millisecond, 0, time.Second)
+	assert.False(t, s.IsDown())
+
+	s.Start()
+	assert.True(t, s.Status().Running)
+	result, err := s.Stop()
+	assert.Nil(t, err)
+	assert.Equal(t, StopGraceful, result)
+
+	time.Sleep(50 * time.Millisecond)
+	status := s.Status()
+	assert.False(t, status.Running)
+	assert.Equal(t, 0, status.Restarts)
+	assert.True(t, s.IsDown())
+}
+
+func TestSupervisorStopEscalatesToKill(t *testing.T) {
+	s := NewSupervisor("test", func() *CommandRunner { return NewCommandRunner("sh", "-c", "trap '' TERM; exec sleep 20") },
+		time.Millisecond, time.Millisecond, 0, 100*time.Millisecond)
+	s.Start()
+	time.Sleep(100 * time.Millisecond)
+
+	result, err := s.Stop()
+	assert.Nil(t, err)
+	assert.Equal(t, StopKilled, result)
+}
+
+func TestSupervisorStopWhenNotRunning(t *testing.T) {
+	s := NewSupervisor("test", nil, time.Millisecond, time.Millisecond, 0, time.Second)
+	result, err := s.Stop()
+	assert.Nil(t, err)
+	assert.Equal(t, StopNotRunning, result)
+}
+
+func TestSupervisorStartWhenRunning(t *testing.T) {
+	launches := 0
+	s := NewSupervisor("test", func() *CommandRunner {
+		launches++
+		return NewCommandRunner("sleep", "20")
+	}, time.Millisecond, time.Millisecond, 0, time.Second)
+
+	s.Start()
+	s.Start()
+	assert.Equal(t, 1, launches)
+	assert.True(t, s.Status().Running)
+
+	result, err := s.Stop()
+	assert.Nil(t, err)
+	assert.Equal(t, StopGraceful, result)
+}
@@ -0,0 +1,171 @@
+/*
+ *  Copyright (c) 2020 AT&T Intellectual Property.
+ *  Copyright (c) 2020 Nokia.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  This source code is part of the near-RT RIC (RAN Intelligent Controller)
+ *  platform project (RICP).
+ *
+ */
+
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	app "gerrit.o-ran-sc.org/r/ric-plt/xapp-frame/pkg/xapp"
+)
+
+// CertificateInfo describes a certificate used on the collector connection
+type CertificateInfo struct {
+	File     string    `json:"file"`
+	Subject  string    `json:"subject"`
+	NotAfter time.Time `json:"notAfter"`
+}
+
+// CollectorTLS contains the TLS material of the collector connection. The VES agent
+// (v0.3.0) verifies the collector with a CA bundle only, it has no settings for a
+// client certificate.
+type CollectorTLS struct {
+	CaCert       string // Content of the CA bundle
+	Certificates []CertificateInfo
+}
+
+// LoadCollectorTLS reads and validates the CA bundle. An empty file name is skipped.
+// An error is returned if the file cannot be parsed, or if any of the certificates
+// has expired.
+func LoadCollectorTLS(caFile string) (CollectorTLS, error) {
+	var c CollectorTLS
+	now := time.Now()
+
+	if caFile != "" {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return c, err
+		}
+		certs, err := parseCertificates(data)
+		if err != nil {
+			return c, fmt.Errorf("%s: %v", caFile, err)
+		}
+		for _, cert := range certs {
+			if err := c.addCertificate(caFile, cert, now); err != nil {
+				return c, err
+			}
+		}
+		c.CaCert = string(data)
+	}
+	return c, nil
+}
+
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM certificates found")
+	}
+	return certs, nil
+}
+
+func (c *CollectorTLS) addCertificate(fname string, cert *x509.Certificate, now time.Time) error {
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("%s: certificate '%s' expired at %v", fname, cert.Subject, cert.NotAfter)
+	}
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("%s: certificate '%s' is not valid before %v", fname, cert.Subject, cert.NotBefore)
+	}
+	c.Certificates = append(c.Certificates, CertificateInfo{File: fname, Subject: cert.Subject.String(), NotAfter: cert.NotAfter})
+	return nil
+}
+
+// NotAfter returns the earliest expiry time of the certificates, or zero time if
+// there are no certificates
+func (c CollectorTLS) NotAfter() time.Time {
+	var notAfter time.Time
+	for _, cert := range c.Certificates {
+		if notAfter.IsZero() || cert.NotAfter.Before(notAfter) {
+			notAfter = cert.NotAfter
+		}
+	}
+	return notAfter
+}
+
+// LoadCollectorTLS loads the TLS material of the collector connection given in the
+// configuration. The certificates are checked again in the validation report.
+func (v *VespaMgr) LoadCollectorTLS() error {
+	c, err := loadCollectorTLS(app.Config.GetString("controls.collector.caCertFile"))
+	v.setCollectorTLS(c, err)
+	return err
+}
+
+// loadCollectorTLS loads the CA bundle, logging the problems found in it and the
+// certificates which expire soon
+func loadCollectorTLS(caFile string) (CollectorTLS, error) {
+	c, err := LoadCollectorTLS(caFile)
+	if err != nil {
+		app.Logger.Error("Invalid collector TLS configuration: %v", err)
+		return c, err
+	}
+
+	warning := getDuration("controls.collector.certExpiryWarning", 30*24*time.Hour)
+	for _, cert := range c.Certificates {
+		if time.Until(cert.NotAfter) < warning {
+			app.Logger.Warn("Certificate '%s' in %s expires at %v", cert.Subject, cert.File, cert.NotAfter)
+		}
+	}
+	return c, nil
+}
+
+func (v *VespaMgr) setCollectorTLS(c CollectorTLS, err error) {
+	v.tlsMu.Lock()
+	defer v.tlsMu.Unlock()
+	v.collectorTLS, v.collectorTLSErr = c, err
+}
+
+func (v *VespaMgr) getCollectorTLS() CollectorTLS {
+	v.tlsMu.Lock()
+	defer v.tlsMu.Unlock()
+	return v.collectorTLS
+}
+
+// checkCollectorTLS tells whether the collector TLS configuration is usable now
+func (v *VespaMgr) checkCollectorTLS() error {
+	v.tlsMu.Lock()
+	defer v.tlsMu.Unlock()
+
+	if v.collectorTLSErr != nil {
+		return v.collectorTLSErr
+	}
+	if notAfter := v.collectorTLS.NotAfter(); !notAfter.IsZero() && time.Now().After(notAfter) {
+		return fmt.Errorf("collector certificate expired at %v", notAfter)
+	}
+	return nil
+}
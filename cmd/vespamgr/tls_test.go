@@ -0,0 +1,125 @@
+/*
+ *  Copyright (c) 2020 AT&T Intellectual Property.
+ *  Copyright (c) 2020 Nokia.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  This source code is part of the near-RT RIC (RAN Intelligent Controller)
+ *  platform project (RICP).
+ *
+ */
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestCertificate writes a self-signed certificate and its key to dir
+func writeTestCertificate(t *testing.T, dir, name string, notAfter time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-48 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	assert.Nil(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	assert.Nil(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func TestLoadCollectorTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	caExpiry := time.Now().Add(365 * 24 * time.Hour).Truncate(time.Second)
+	caFile, _ := writeTestCertificate(t, dir, "ca", caExpiry)
+
+	c, err := LoadCollectorTLS(caFile)
+	assert.Nil(t, err)
+	caData, _ := ioutil.ReadFile(caFile)
+	assert.Equal(t, string(caData), c.CaCert)
+	assert.Equal(t, 1, len(c.Certificates))
+	assert.True(t, caExpiry.Equal(c.NotAfter()))
+
+	c, err = LoadCollectorTLS("")
+	assert.Nil(t, err)
+	assert.True(t, c.NotAfter().IsZero())
+}
+
+func TestLoadCollectorTLSFailures(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	expiredFile, _ := writeTestCertificate(t, dir, "expired", time.Now().Add(-time.Hour))
+	_, err = LoadCollectorTLS(expiredFile)
+	assert.Contains(t, err.Error(), "expired")
+
+	garbage := filepath.Join(dir, "garbage.pem")
+	ioutil.WriteFile(garbage, []byte("not a certificate"), 0644)
+	_, err = LoadCollectorTLS(garbage)
+	assert.Contains(t, err.Error(), "no PEM certificates found")
+
+	_, err = LoadCollectorTLS(filepath.Join(dir, "missing.pem"))
+	assert.NotNil(t, err)
+}
+
+func TestCollectorTLSInConfigAndStatus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	caFile, _ := writeTestCertificate(t, dir, "ca", time.Now().Add(time.Hour))
+
+	vesmgr := NewVespaMgr()
+	vesmgr.rmrReady = true
+	vesmgr.collectorTLS, vesmgr.collectorTLSErr = LoadCollectorTLS(caFile)
+	assert.Nil(t, vesmgr.collectorTLSErr)
+	assert.True(t, vesmgr.StatusCB())
+	assert.Empty(t, vesmgr.ValidationReport().CollectorTLS)
+
+	vesconf, _, _ := vesmgr.buildCurrentConfig([]byte{})
+	assert.Contains(t, vesconf.CaCert, "BEGIN CERTIFICATE")
+
+	// An expired certificate is reported, but does not make the xApp not ready
+	vesmgr.collectorTLS.Certificates[0].NotAfter = time.Now().Add(-time.Second)
+	assert.True(t, vesmgr.StatusCB())
+	assert.Contains(t, vesmgr.ValidationReport().CollectorTLS, "expired")
+
+	vesmgr.collectorTLSErr = fmt.Errorf("ca.crt: no PEM certificates found")
+	assert.True(t, vesmgr.StatusCB())
+	assert.Equal(t, "ca.crt: no PEM certificates found", vesmgr.ValidationReport().CollectorTLS)
+}
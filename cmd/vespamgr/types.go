@@ -22,24 +22,59 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"sync"
 	"time"
 )
 
 type VespaMgr struct {
-	rmrReady             bool
-	vesAgent             *CommandRunner
-	chVesagent           chan error
+	vespaSettings
+	settingsMu       sync.RWMutex
+	ctx              context.Context // Cancelled on shutdown
+	cancel           context.CancelFunc
+	rmrReady         bool
+	vesAgent         *Supervisor
+	agentMu          sync.Mutex // Serializes starting and stopping the VES agent
+	subsMu           sync.Mutex
+	subscriptionId   string
+	subscribing      bool
+	pltFileCreated   bool
+	pltMu            sync.Mutex
+	agentLog         *OutputLog
+	chXappNotif      chan struct{}
+	confMu           sync.Mutex
+	appliedConf      *VESAgentConfiguration
+	reportMu         sync.Mutex
+	validationReport ValidationReport
+	ruleSources      []RuleSource
+	appliedStatus    AppliedStatus
+	tlsMu            sync.Mutex
+	collectorTLS     CollectorTLS
+	collectorTLSErr  error
+	xappConf         []byte
+	xappEntries      map[string]json.RawMessage
+	xappFetches      uint64 // xApp configuration fetches started
+	xappFetchApplied uint64 // Fetch whose xApp configurations are in xappConf
+	notifMu          sync.Mutex
+	pendingNotifs    []*XappNotification
+}
+
+// vespaSettings are the controls read from the configuration at startup, and again
+// when the configuration changes
+type vespaSettings struct {
 	appmgrHost           string
 	appmgrUrl            string
 	appmgrNotifUrl       string
 	appmgrSubsUrl        string
 	appmgrRetry          int
+	retryBackoff         time.Duration
+	retryMaxBackoff      time.Duration
+	requestTimeout       time.Duration
 	hbInterval           string
 	measInterval         string
 	prometheusAddr       string
 	alertManagerBindAddr string
-	subscriptionId       string
-	pltFileCreated       bool
 }
 
 // Structs are copied from https://github.com/nokia/ONAP-VESPA/tree/master/ves-agent/config
@@ -104,7 +139,7 @@ type CollectorConfiguration struct {
 	PassPhrase string `yaml:"passphrase,omitempty"` // passPhrase used to encrypt collector password in file
 }
 
-//NfcNamingCode mapping bettween NfcNamingCode (oam or etl) and Vnfcs
+// NfcNamingCode mapping bettween NfcNamingCode (oam or etl) and Vnfcs
 type NfcNamingCode struct {
 	Type  string   `yaml:"type"`
 	Vnfcs []string `yaml:"vnfcs"`
@@ -125,6 +160,7 @@ type EventConfiguration struct {
 // VESAgentConfiguration parameters
 type VESAgentConfiguration struct {
 	PrimaryCollector CollectorConfiguration   `yaml:"primaryCollector"`
+	BackupCollector  CollectorConfiguration   `yaml:"backupCollector,omitempty"` // Used when the primary collector is unreachable
 	Heartbeat        HeartbeatConfiguration   `yaml:"heartbeat,omitempty"`
 	Measurement      MeasurementConfiguration `yaml:"measurement,omitempty"`
 	Event            EventConfiguration       `yaml:"event,omitempty"`
@@ -133,8 +169,59 @@ type VESAgentConfiguration struct {
 	DataDir          string                   `yaml:"datadir"`          // Path to directory containing data
 }
 
+// XappConfig is an entry of the xApp configuration list returned by appmgr.
+// Only the measurements of the xApp configuration are modelled.
+type XappConfig struct {
+	Metadata XappMetadata    `json:"metadata"`
+	Config   XappConfigModel `json:"config"`
+}
+
+// XappMetadata identifies the xApp of a configuration
+type XappMetadata struct {
+	XappName  string `json:"xappName,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// Instance identifies the deployment of the xApp. The same xApp can be deployed
+// in several namespaces.
+func (m XappMetadata) Instance() string {
+	if m.Namespace == "" || m.XappName == "" {
+		return m.XappName
+	}
+	return m.Namespace + "/" + m.XappName
+}
+
+// XappConfigModel contains the measurements section of an xApp configuration
+type XappConfigModel struct {
+	Measurements []Measurement `json:"measurements,omitempty"`
+}
+
+// Measurement defines a group of counters reported to VES
+type Measurement struct {
+	MoId         string   `json:"moId"`
+	MeasType     string   `json:"measType"`
+	MeasId       string   `json:"measId"`
+	MeasInterval string   `json:"measInterval"`
+	Metrics      []Metric `json:"metrics"`
+}
+
+// Metric maps a Prometheus counter to a VES object
+type Metric struct {
+	Name           string `json:"name"`
+	ObjectName     string `json:"objectName"`
+	ObjectInstance string `json:"objectInstance"`
+	CounterId      string `json:"counterId"`
+	Type           string `json:"type,omitempty"`
+	Unit           string `json:"unit,omitempty"`
+	Description    string `json:"description,omitempty"`
+}
+
 // AppMetricsStruct contains xapplication metrics definition
 type AppMetricsStruct struct {
+	Source         string // Where the metric was defined: appmgr, pltFile/<component> or pltCounterFile
+	XApp           string
+	Namespace      string
+	Name           string
 	MoId           string
 	MeasType       string
 	MeasId         string
@@ -142,10 +229,38 @@ type AppMetricsStruct struct {
 	ObjectName     string
 	ObjectInstance string
 	CounterId      string
+	Type           string
+	Unit           string
+	Description    string
 }
 
-// AppMetrics contains metrics definitions for all Xapps
+// AppMetrics contains metrics definitions for all Xapps, keyed by xApp instance
+// and counter name
 type AppMetrics map[string]AppMetricsStruct
 
 var Version string
 var Hash string
+
+// XappNotification is the xApp event notification sent by appmgr
+type XappNotification struct {
+	Id        string         `json:"id"`
+	Version   int64          `json:"version"`
+	EventType string         `json:"eventType"`
+	XApps     []NotifiedXapp `json:"xApps"`
+}
+
+// NotifiedXapp is an xApp told about in a notification
+type NotifiedXapp struct {
+	Name      string         `json:"name"`
+	Status    string         `json:"status,omitempty"`
+	Version   string         `json:"version,omitempty"`
+	Instances []XappInstance `json:"instances,omitempty"`
+}
+
+// XappInstance is an instance of a notified xApp
+type XappInstance struct {
+	Name   string `json:"name"`
+	Status string `json:"status,omitempty"`
+	IP     string `json:"ip,omitempty"`
+	Port   int64  `json:"port,omitempty"`
+}
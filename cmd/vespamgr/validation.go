@@ -0,0 +1,93 @@
+/*
+ *  Copyright (c) 2020 AT&T Intellectual Property.
+ *  Copyright (c) 2020 Nokia.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  This source code is part of the near-RT RIC (RAN Intelligent Controller)
+ *  platform project (RICP).
+ *
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Reasons for rejecting a part of a measurement descriptor
+const (
+	reasonInvalidJSON  = "invalid JSON"
+	reasonMissing      = "missing"
+	reasonNotString    = "not a string"
+	reasonNotObject    = "not an object"
+	reasonNotArray     = "not an array"
+	reasonDuplicate    = "duplicate counter name"
+	reasonConflict     = "conflicting counter definition"
+	reasonInvalidValue = "invalid value"
+	reasonUnknownField = "unknown field"
+)
+
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// ValidationError tells which part of a measurement descriptor was rejected, and why
+type ValidationError struct {
+	Severity    string `json:"severity"`
+	Source      string `json:"source,omitempty"`
+	XApp        string `json:"xapp,omitempty"`
+	Measurement string `json:"measurement,omitempty"`
+	Metric      string `json:"metric,omitempty"`
+	Field       string `json:"field,omitempty"`
+	Reason      string `json:"reason"`
+}
+
+func (e ValidationError) Error() string {
+	var where []string
+	for _, part := range []struct{ name, value string }{
+		{"source", e.Source}, {"xapp", e.XApp}, {"measurement", e.Measurement}, {"metric", e.Metric}, {"field", e.Field},
+	} {
+		if part.value != "" {
+			where = append(where, fmt.Sprintf("%s=%s", part.name, part.value))
+		}
+	}
+	return fmt.Sprintf("%s: %s: %s", e.Severity, strings.Join(where, " "), e.Reason)
+}
+
+// ValidationReport contains the problems found when the VES agent configuration
+// was last generated
+type ValidationReport struct {
+	Time         time.Time         `json:"time"`
+	Errors       []ValidationError `json:"errors"`
+	CollectorTLS string            `json:"collectorTLS,omitempty"` // Why the collector TLS configuration is not usable
+}
+
+func (v *VespaMgr) ValidationReport() ValidationReport {
+	v.reportMu.Lock()
+	report := v.validationReport
+	v.reportMu.Unlock()
+
+	if err := v.checkCollectorTLS(); err != nil {
+		report.CollectorTLS = err.Error()
+	}
+	return report
+}
+
+func (v *VespaMgr) HandleValidationReport(w http.ResponseWriter, r *http.Request) {
+	v.respondWithJSON(w, http.StatusOK, v.ValidationReport())
+}
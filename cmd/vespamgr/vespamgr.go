@@ -22,11 +22,15 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -34,14 +38,33 @@ import (
 )
 
 func NewVespaMgr() *VespaMgr {
-	return &VespaMgr{
-		rmrReady:             false,
-		chVesagent:           make(chan error),
+	ctx, cancel := context.WithCancel(context.Background())
+	v := &VespaMgr{
+		vespaSettings: readSettings(),
+		rmrReady:      false,
+		chXappNotif:   make(chan struct{}, 1),
+		agentLog:      newAgentLog(),
+		ctx:           ctx,
+		cancel:        cancel,
+	}
+	v.vesAgent = NewSupervisor("ves-agent", v.newVesagentRunner,
+		getDuration("controls.vesagent.restartBackoff", time.Second),
+		getDuration("controls.vesagent.restartMaxBackoff", time.Minute),
+		app.Config.GetInt("controls.vesagent.maxRestarts"),
+		getDuration("controls.vesagent.drainTimeout", 10*time.Second))
+	return v
+}
+
+func readSettings() vespaSettings {
+	return vespaSettings{
 		appmgrHost:           app.Config.GetString("controls.appManager.host"),
 		appmgrUrl:            app.Config.GetString("controls.appManager.path"),
 		appmgrNotifUrl:       app.Config.GetString("controls.appManager.notificationUrl"),
 		appmgrSubsUrl:        app.Config.GetString("controls.appManager.subscriptionUrl"),
 		appmgrRetry:          app.Config.GetInt("controls.appManager.appmgrRetry"),
+		retryBackoff:         getDuration("controls.appManager.retryBackoff", 5*time.Second),
+		retryMaxBackoff:      getDuration("controls.appManager.retryMaxBackoff", time.Minute),
+		requestTimeout:       getDuration("controls.appManager.requestTimeout", 10*time.Second),
 		hbInterval:           app.Config.GetString("controls.vesagent.hbInterval"),
 		measInterval:         app.Config.GetString("controls.vesagent.measInterval"),
 		prometheusAddr:       app.Config.GetString("controls.vesagent.prometheusAddr"),
@@ -49,21 +72,113 @@ func NewVespaMgr() *VespaMgr {
 	}
 }
 
+func (s vespaSettings) validate() error {
+	if s.appmgrHost == "" || s.appmgrUrl == "" || s.appmgrNotifUrl == "" || s.appmgrSubsUrl == "" {
+		return fmt.Errorf("appmgr host and paths must be set")
+	}
+	for _, interval := range []string{s.hbInterval, s.measInterval} {
+		if d, err := time.ParseDuration(interval); err != nil || d <= 0 {
+			return fmt.Errorf("invalid interval '%s'", interval)
+		}
+	}
+	if s.prometheusAddr == "" {
+		return fmt.Errorf("prometheus address must be set")
+	}
+	if app.Config.GetString("controls.collector.primaryAddr") == "" {
+		return fmt.Errorf("primary collector address must be set")
+	}
+	if port := app.Config.GetInt("controls.collector.primaryPort"); port <= 0 || port > 65535 {
+		return fmt.Errorf("invalid primary collector port %d", port)
+	}
+	return nil
+}
+
+// agentArgsChanged tells whether the settings passed to the VES agent on its command line differ
+func (s vespaSettings) agentArgsChanged(other vespaSettings) bool {
+	return s.hbInterval != other.hbInterval || s.measInterval != other.measInterval ||
+		s.prometheusAddr != other.prometheusAddr || s.alertManagerBindAddr != other.alertManagerBindAddr
+}
+
+// appmgrChanged tells whether the settings used for reaching appmgr differ
+func (s vespaSettings) appmgrChanged(other vespaSettings) bool {
+	return s.appmgrHost != other.appmgrHost || s.appmgrUrl != other.appmgrUrl ||
+		s.appmgrNotifUrl != other.appmgrNotifUrl || s.appmgrSubsUrl != other.appmgrSubsUrl
+}
+
+// subscriptionChanged tells whether the xApp notifications must be subscribed again
+func (s vespaSettings) subscriptionChanged(other vespaSettings) bool {
+	return s.appmgrHost != other.appmgrHost || s.appmgrNotifUrl != other.appmgrNotifUrl ||
+		s.appmgrSubsUrl != other.appmgrSubsUrl
+}
+
+func (s vespaSettings) retryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: s.appmgrRetry,
+		MinBackoff:  s.retryBackoff,
+		MaxBackoff:  s.retryMaxBackoff,
+		Timeout:     s.requestTimeout,
+	}
+}
+
+func (v *VespaMgr) settings() vespaSettings {
+	v.settingsMu.RLock()
+	defer v.settingsMu.RUnlock()
+	return v.vespaSettings
+}
+
+func newAgentLog() *OutputLog {
+	size := app.Config.GetInt("controls.vesagent.logLines")
+	if size <= 0 {
+		size = 500
+	}
+	return NewOutputLog(size, app.Config.GetBool("controls.vesagent.logToLogger"))
+}
+
+// getDuration reads a duration string (e.g. "30s") from the configuration,
+// falling back to the given default if the value is missing or invalid
+func getDuration(key string, defaultValue time.Duration) time.Duration {
+	value := app.Config.GetString(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		app.Logger.Error("Invalid duration '%s' for %s, using %v", value, key, defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
 func (v *VespaMgr) Run(sdlcheck, runXapp bool) {
 	app.Logger.SetMdc("vespamgr", fmt.Sprintf("%s:%s", Version, Hash))
 	app.SetReadyCB(func(d interface{}) { v.rmrReady = true }, true)
 	app.Resource.InjectStatusCb(v.StatusCB)
 	app.AddConfigChangeListener(v.ConfigChangeCB)
+	v.LoadCollectorTLS()
+	v.LoadPltMeasurements()
 
 	measUrl := app.Config.GetString("controls.measurementUrl")
 	app.Resource.InjectRoute(v.appmgrNotifUrl, v.HandlexAppNotification, "POST")
 	app.Resource.InjectRoute(measUrl, v.HandleMeasurements, "POST")
+	app.Resource.InjectRoute(measUrl, v.HandleMeasurementList, "GET")
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		app.Resource.InjectRoute(measUrl+"/{component}", v.HandleComponentMeasurements, method)
+	}
 	app.Resource.InjectRoute("/supervision", v.HandleSupervision, "GET") // @todo: remove this
 	app.Resource.InjectRoute("/ric/v1/symptomdata", v.SymptomDataHandler, "GET")
+	app.Resource.InjectRoute("/ric/v1/validation", v.HandleValidationReport, "GET")
+	app.Resource.InjectRoute("/ric/v1/vesagent/config", v.HandleEffectiveConfig, "GET")
+	app.Resource.InjectRoute("/ric/v1/vesagent/rules", v.HandleRules, "GET")
+	app.Resource.InjectRoute("/ric/v1/vesagent/status", v.HandleAppliedStatus, "GET")
+	app.Resource.InjectRoute("/ric/v1/vesagent/preview", v.HandleRulePreview, "POST")
 
 	go v.SubscribeXappNotif(fmt.Sprintf("%s%s", v.appmgrHost, v.appmgrSubsUrl))
+	go v.CoalesceXappNotifications(getDuration("controls.appManager.notificationQuietPeriod", 2*time.Second))
+	go v.MonitorSubscription(getDuration("controls.appManager.subscriptionCheckInterval", time.Minute))
+	go v.RunReconciler(getDuration("controls.appManager.reconcileInterval", 5*time.Minute))
 
 	if runXapp {
+		app.SetShutdownCB(v.Shutdown)
 		app.RunWithParams(v, sdlcheck)
 	}
 }
@@ -77,6 +192,10 @@ func (v *VespaMgr) SymptomDataHandler(w http.ResponseWriter, r *http.Request) {
 
 	baseDir := app.Resource.CollectDefaultSymptomData("app-config.json", appConfig)
 	if baseDir != "" {
+		agentLog := strings.Join(v.agentLog.Lines(), "\n")
+		if err := ioutil.WriteFile(filepath.Join(baseDir, "ves-agent.log"), []byte(agentLog), 0644); err != nil {
+			app.Logger.Error("Unable to write ves-agent log: %v", err)
+		}
 		app.Resource.SendSymptomDataFile(w, r, baseDir, "symptomdata.zip")
 	}
 }
@@ -91,136 +210,610 @@ func (v *VespaMgr) Consume(rp *app.RMRParams) (err error) {
 func (v *VespaMgr) StatusCB() bool {
 	if !v.rmrReady {
 		app.Logger.Info("RMR not ready yet!")
+		return false
+	}
+
+	if v.vesAgent.IsDown() {
+		status := v.vesAgent.Status()
+		app.Logger.Info("VES agent not running: restarts=%d lastExit=%s", status.Restarts, status.LastExit)
+		return false
 	}
 
-	return v.rmrReady
+	return true
 }
 
 func (v *VespaMgr) ConfigChangeCB(configparam string) {
-	return
+	app.Logger.Info("Configuration changed: %s", configparam)
+	v.applyConfigChange(readSettings(), app.Config.GetString("controls.collector.caCertFile"))
 }
 
-func (v *VespaMgr) CreateConf(fname string, xappMetrics []byte) {
-	f, err := os.Create(fname)
+// applyConfigChange takes the changed settings and collector CA bundle into use. It
+// returns false if the change was rejected, keeping the current configuration.
+func (v *VespaMgr) applyConfigChange(settings vespaSettings, caFile string) bool {
+	if err := settings.validate(); err != nil {
+		app.Logger.Error("Configuration change rejected, keeping the current configuration: %v", err)
+		return false
+	}
+	c, err := loadCollectorTLS(caFile)
 	if err != nil {
-		app.Logger.Error("os.Create failed: %s", err.Error())
+		app.Logger.Error("Configuration change rejected, keeping the current configuration: %v", err)
+		return false
+	}
+	v.setCollectorTLS(c, nil)
+	v.ApplySettings(settings)
+	return true
+}
+
+// ApplySettings takes new settings into use. The VES agent configuration is
+// regenerated, and the agent restarted if the change affects it. If the appmgr
+// settings changed, the xApp configurations are fetched from the new location, and
+// if the subscription settings changed, the old subscription is deleted and the
+// xApp notifications are subscribed again.
+func (v *VespaMgr) ApplySettings(settings vespaSettings) {
+	v.settingsMu.Lock()
+	previous := v.vespaSettings
+	if settings.appmgrNotifUrl != previous.appmgrNotifUrl {
+		// The route of the notification URL cannot be removed at runtime
+		app.Logger.Error("Changing the notification URL from %s to %s needs a restart, keeping %s",
+			previous.appmgrNotifUrl, settings.appmgrNotifUrl, previous.appmgrNotifUrl)
+		settings.appmgrNotifUrl = previous.appmgrNotifUrl
+	}
+	v.vespaSettings = settings
+	v.settingsMu.Unlock()
+
+	restart := settings.agentArgsChanged(previous)
+	if settings.subscriptionChanged(previous) {
+		app.Logger.Info("appmgr subscription settings changed, subscribing again")
+		go func() {
+			if id := v.getSubscriptionId(); id != "" {
+				v.DoUnsubscribe(fmt.Sprintf("%s%s", previous.appmgrHost, previous.appmgrSubsUrl), id)
+			}
+			v.subscribeXappNotif(fmt.Sprintf("%s%s", settings.appmgrHost, settings.appmgrSubsUrl))
+			v.updateVesagentConfig(restart)
+		}()
+		return
+	}
+	if settings.appmgrChanged(previous) {
+		app.Logger.Info("appmgr settings changed, fetching the xApp configurations again")
+		go v.updateVesagentConfig(restart)
 		return
 	}
-	defer f.Close()
+	v.reconfigureVesagent(restart)
+}
 
-	v.CreateConfig(f, xappMetrics)
+// reconfigureVesagent regenerates the VES agent configuration from the xApp
+// configurations fetched last, and restarts the agent if the configuration changed
+// or if forced to
+func (v *VespaMgr) reconfigureVesagent(forceRestart bool) {
+	v.confMu.Lock()
+	defer v.confMu.Unlock()
+
+	// Without the xApp configurations the rules of all xApps would be dropped. The
+	// configuration is generated with the current settings once they are fetched.
+	if v.xappConf == nil {
+		app.Logger.Info("xApp configurations not fetched yet, VES agent configuration not updated")
+		return
+	}
+
+	if v.CreateConf(app.Config.GetString("controls.vesagent.configFile"), v.xappConf) || forceRestart {
+		v.RestartVesagent()
+	}
 }
 
-func (v *VespaMgr) QueryXappConf(appmgrUrl string) (appConfig []byte, err error) {
-	client := http.Client{Timeout: 10 * time.Second}
+// CreateConf generates the VES agent configuration for the given xApp configurations
+// and writes it to the file, unless it equals the configuration applied earlier.
+// It returns true if a new configuration was written.
+func (v *VespaMgr) CreateConf(fname string, xappMetrics []byte) bool {
+	vespaconf, sources, errs := v.buildCurrentConfig(xappMetrics)
+	if v.appliedConf != nil {
+		diff := DiffConfig(v.appliedConf, &vespaconf)
+		if len(diff) == 0 {
+			app.Logger.Info("VES agent configuration unchanged")
+			v.setAppliedStatus(v.appliedConf, nil, sources, errs)
+			return false
+		}
+		app.Logger.Info("VES agent configuration changed (%d differences): %s", len(diff), strings.Join(diff, "; "))
+	}
 
-	for i := 0; i < v.appmgrRetry; i++ {
-		app.Logger.Info("Getting xApp config from: %s [%d]", appmgrUrl, v.appmgrRetry)
+	data, err := encodeConfig(&vespaconf)
+	if err != nil {
+		app.Logger.Error("Cannot encode vespa conf: %s", err.Error())
+		return false
+	}
+	// The configuration contains the collector credentials
+	err = writeFileAtomic(fname, 0600, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		app.Logger.Error("Cannot write vespa conf file: %s", err.Error())
+		return false
+	}
+	app.Logger.Info("Config file written to: %s", fname)
 
-		resp, err := client.Get(appmgrUrl)
-		if err != nil || resp == nil {
-			app.Logger.Error("client.Get failed: %v", err)
-			time.Sleep(5 * time.Second)
-			continue
+	v.appliedConf = &vespaconf
+	v.setAppliedStatus(&vespaconf, data, sources, errs)
+	return true
+}
+
+// writeFileAtomic replaces the content of the file with the data produced by write.
+// The data goes first to a temporary file in the same directory, which is synced
+// and then renamed over the file, so the file never has partial content. The
+// previous content of the file is kept in a ".bak" file, which is written the same
+// way and gets the same permissions.
+func writeFileAtomic(fname string, perm os.FileMode, write func(io.Writer) error) error {
+	tmpName, err := writeTempFile(fname, perm, write)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+
+	if previous, err := ioutil.ReadFile(fname); err == nil {
+		if err := keepBackup(fname+".bak", perm, previous); err != nil {
+			app.Logger.Warn("Unable to keep backup of %s: %v", fname, err)
 		}
+	}
+	return renameSynced(tmpName, fname)
+}
 
-		defer resp.Body.Close()
-		appConfig, err := ioutil.ReadAll(resp.Body)
+func keepBackup(fname string, perm os.FileMode, data []byte) error {
+	tmpName, err := writeTempFile(fname, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpName)
+	return renameSynced(tmpName, fname)
+}
+
+// writeTempFile writes the data produced by write to a synced temporary file next
+// to fname, and returns the name of the temporary file
+func writeTempFile(fname string, perm os.FileMode, write func(io.Writer) error) (string, error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(fname), filepath.Base(fname)+".tmp")
+	if err != nil {
+		return "", err
+	}
+
+	err = write(tmp)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), perm)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+func renameSynced(tmpName, fname string) error {
+	if err := os.Rename(tmpName, fname); err != nil {
+		return err
+	}
+	if d, err := os.Open(filepath.Dir(fname)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// fetchXappConfigs queries the xApp configurations from appmgr without holding
+// confMu, so that the retries do not block the other configuration updates. The
+// returned sequence number is given to acceptXappFetch before using the result.
+func (v *VespaMgr) fetchXappConfigs() (uint64, []byte, error) {
+	v.confMu.Lock()
+	v.xappFetches++
+	seq := v.xappFetches
+	v.confMu.Unlock()
+
+	settings := v.settings()
+	appConfig, err := v.QueryXappConf(fmt.Sprintf("%s%s", settings.appmgrHost, settings.appmgrUrl))
+	return seq, appConfig, err
+}
+
+// acceptXappFetch returns false if the configurations of a later fetch were already
+// applied, so that a slow fetch does not overwrite them. confMu must be held.
+func (v *VespaMgr) acceptXappFetch(seq uint64) bool {
+	if seq < v.xappFetchApplied {
+		return false
+	}
+	v.xappFetchApplied = seq
+	return true
+}
+
+// QueryXappConf fetches the xApp configurations from appmgr, retrying according
+// to the retry policy. Only a successful JSON response containing a list is
+// accepted, anything else, like an error page, is returned as an error.
+func (v *VespaMgr) QueryXappConf(appmgrUrl string) ([]byte, error) {
+	var appConfig []byte
+	err := v.settings().retryPolicy().Do(v.ctx, "Getting xApp config", func(ctx context.Context) error {
+		app.Logger.Info("Getting xApp config from: %s", appmgrUrl)
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, appmgrUrl, nil)
 		if err != nil {
-			app.Logger.Error("ioutil.ReadAll failed: %v", err)
-			time.Sleep(5 * time.Second)
-			continue
+			return err
 		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
 
-		app.Logger.Info("Received xApp config: %d", len(appConfig))
-		if len(appConfig) > 0 {
-			return appConfig, err
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("unexpected status %d", resp.StatusCode)
+		}
+		contentType := resp.Header.Get("Content-Type")
+		if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "application/json" {
+			return fmt.Errorf("unexpected content type '%s'", contentType)
 		}
-	}
 
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		app.Logger.Info("Received xApp config: %d", len(body))
+		var list []json.RawMessage
+		if err := json.Unmarshal(body, &list); err != nil {
+			return fmt.Errorf("xApp config is not a JSON list: %v", err)
+		}
+		appConfig = body
+		return nil
+	})
 	return appConfig, err
 }
 
+// ReadPayload reads a JSON request body. If the body is not acceptable, an error
+// response is sent and an error returned. Otherwise the caller has to respond.
 func (v *VespaMgr) ReadPayload(w http.ResponseWriter, r *http.Request) ([]byte, error) {
-	payload, err := ioutil.ReadAll(r.Body)
 	defer r.Body.Close()
+
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "application/json" {
+			err = fmt.Errorf("unsupported content type '%s'", contentType)
+			v.respondWithError(w, http.StatusUnsupportedMediaType, err)
+			return nil, err
+		}
+	}
+
+	maxSize := app.Config.GetInt("controls.maxPayloadSize")
+	if maxSize <= 0 {
+		maxSize = 1024 * 1024
+	}
+	// One byte more than allowed is read to tell a too large payload apart
+	payload, err := ioutil.ReadAll(io.LimitReader(r.Body, int64(maxSize)+1))
 	if err != nil {
 		app.Logger.Error("ioutil.ReadAll failed: %v", err)
-		return payload, err
+		v.respondWithError(w, http.StatusBadRequest, err)
+		return nil, err
+	}
+	if len(payload) > maxSize {
+		err = fmt.Errorf("payload larger than %d bytes", maxSize)
+		v.respondWithError(w, http.StatusRequestEntityTooLarge, err)
+		return nil, err
 	}
-	v.respondWithJSON(w, http.StatusOK, err)
 
-	return payload, err
+	if !json.Valid(payload) {
+		err = fmt.Errorf("payload is not valid JSON")
+		v.respondWithError(w, http.StatusBadRequest, err)
+		return nil, err
+	}
+	return payload, nil
 }
 
 func (v *VespaMgr) HandleSupervision(w http.ResponseWriter, r *http.Request) {
 	v.respondWithJSON(w, http.StatusOK, nil)
 }
 
-func (v *VespaMgr) HandleMeasurements(w http.ResponseWriter, r *http.Request) {
-	if appConfig, err := v.ReadPayload(w, r); err == nil {
-		filePath := app.Config.GetString("controls.pltFile")
-		if err := ioutil.WriteFile(filePath, appConfig, 0666); err == nil {
-			v.pltFileCreated = true
+func (v *VespaMgr) HandlexAppNotification(w http.ResponseWriter, r *http.Request) {
+	payload, err := v.ReadPayload(w, r)
+	if err != nil {
+		return
+	}
+
+	notif, err := ParseXappNotification(payload)
+	if err != nil {
+		app.Logger.Warn("Unusable xApp event notification, resyncing all xApps: %v", err)
+	} else {
+		app.Logger.Info("xApp event notification received: %s", notif)
+	}
+	v.queueXappNotification(notif)
+	v.respondWithJSON(w, http.StatusOK, nil)
+}
+
+// CoalesceXappNotifications waits for xApp notifications and updates the VES agent
+// configuration once the notifications have stopped arriving for the quiet period.
+// A burst of notifications thus causes only one update and agent restart.
+func (v *VespaMgr) CoalesceXappNotifications(quietPeriod time.Duration) {
+	for {
+		select {
+		case <-v.chXappNotif:
+		case <-v.ctx.Done():
+			return
+		}
+
+		timer := time.NewTimer(quietPeriod)
+		for pending := true; pending; {
+			select {
+			case <-v.chXappNotif:
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(quietPeriod)
+			case <-timer.C:
+				pending = false
+			case <-v.ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+
+		if notifs := v.takeXappNotifications(); len(notifs) > 0 {
+			v.ApplyXappNotifications(notifs)
 		}
 	}
 }
 
-func (v *VespaMgr) HandlexAppNotification(w http.ResponseWriter, r *http.Request) {
-	if _, err := v.ReadPayload(w, r); err != nil {
-		return
+// UpdateVesagentConfig fetches the latest xApp configurations from appmgr,
+// regenerates the VES agent configuration and restarts the agent
+func (v *VespaMgr) UpdateVesagentConfig() {
+	v.updateVesagentConfig(false)
+}
+
+// updateVesagentConfig returns true if the VES agent configuration changed
+func (v *VespaMgr) updateVesagentConfig(forceRestart bool) (bool, error) {
+	seq, appConfig, err := v.fetchXappConfigs()
+	if err != nil {
+		app.Logger.Warn("Keeping the last known good VES agent configuration: %v", err)
+		if forceRestart {
+			v.confMu.Lock()
+			v.RestartVesagent()
+			v.confMu.Unlock()
+		}
+		return false, err
 	}
 
-	app.Logger.Info("xApp event notification received!")
-	if appConfig, err := v.QueryXappConf(fmt.Sprintf("%s%s", v.appmgrHost, v.appmgrUrl)); err == nil {
-		v.CreateConf(app.Config.GetString("controls.vesagent.configFile"), appConfig)
+	v.confMu.Lock()
+	defer v.confMu.Unlock()
+
+	if !v.acceptXappFetch(seq) {
+		app.Logger.Info("Newer xApp configurations already applied, dropping the ones fetched earlier")
+		if forceRestart {
+			v.RestartVesagent()
+		}
+		return false, nil
+	}
+	v.xappConf = appConfig
+	if v.xappEntries, err = splitXappConfigs(appConfig); err != nil {
+		app.Logger.Warn("Unable to split the xApp configurations: %v", err)
+	}
+	changed := v.CreateConf(app.Config.GetString("controls.vesagent.configFile"), appConfig)
+	if changed || forceRestart {
 		v.RestartVesagent()
 	}
+	return changed, nil
 }
 
 func (v *VespaMgr) DoSubscribe(appmgrUrl string, subscriptionData []byte) string {
-	resp, err := http.Post(appmgrUrl, "application/json", bytes.NewBuffer(subscriptionData))
-	if err != nil || resp == nil || resp.StatusCode != http.StatusCreated {
-		app.Logger.Error("http.Post failed: %s", err)
-		return ""
+	ctx, cancel := v.settings().retryPolicy().withTimeout(v.ctx)
+	defer cancel()
+
+	id, err := v.doSubscribe(ctx, appmgrUrl, subscriptionData)
+	if err != nil {
+		app.Logger.Error("Subscribing failed: %v", err)
+	}
+	return id
+}
+
+func (v *VespaMgr) doSubscribe(ctx context.Context, appmgrUrl string, subscriptionData []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, appmgrUrl, bytes.NewBuffer(subscriptionData))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("unexpected status %d", resp.StatusCode)
 	}
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		app.Logger.Error("ioutil.ReadAll for body failed: %s", err)
-		return ""
+		return "", err
 	}
 
 	var result map[string]interface{}
 	if err := json.Unmarshal([]byte(body), &result); err != nil {
-		app.Logger.Error("json.Unmarshal failed: %s", err)
-		return ""
+		return "", err
 	}
-	v.subscriptionId = result["id"].(string)
-	app.Logger.Info("Subscription id from the response: %s", v.subscriptionId)
+	id, _ := result["id"].(string)
+	if id == "" {
+		return "", fmt.Errorf("no subscription id in the response")
+	}
+	app.Logger.Info("Subscription id from the response: %s", id)
+
+	v.subsMu.Lock()
+	v.subscriptionId = id
+	v.subsMu.Unlock()
+	return id, nil
+}
 
+func (v *VespaMgr) getSubscriptionId() string {
+	v.subsMu.Lock()
+	defer v.subsMu.Unlock()
 	return v.subscriptionId
 }
 
+func (v *VespaMgr) isSubscribing() bool {
+	v.subsMu.Lock()
+	defer v.subsMu.Unlock()
+	return v.subscribing
+}
+
+// DoUnsubscribe deletes the xApp notification subscription from appmgr. It is used
+// during shutdown, so it is not cancelled with the other appmgr requests.
+func (v *VespaMgr) DoUnsubscribe(appmgrUrl, id string) bool {
+	ctx, cancel := v.settings().retryPolicy().withTimeout(context.Background())
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, fmt.Sprintf("%s/%s", appmgrUrl, id), nil)
+	if err != nil {
+		app.Logger.Error("http.NewRequest failed: %s", err)
+		return false
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		app.Logger.Error("Unsubscribing failed: %s", err)
+		return false
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		app.Logger.Error("Unsubscribing failed: status=%d", resp.StatusCode)
+		return false
+	}
+
+	v.subsMu.Lock()
+	if v.subscriptionId == id {
+		v.subscriptionId = ""
+	}
+	v.subsMu.Unlock()
+	app.Logger.Info("Subscription deleted, id=%s", id)
+	return true
+}
+
+// SubscriptionExists asks appmgr whether the subscription is still known. An error
+// is returned if appmgr could not tell.
+func (v *VespaMgr) SubscriptionExists(appmgrUrl, id string) (bool, error) {
+	ctx, cancel := v.settings().retryPolicy().withTimeout(v.ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/%s", appmgrUrl, id), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, fmt.Errorf("unexpected status %d", resp.StatusCode)
+}
+
+// CheckSubscription subscribes the xApp notifications again if appmgr has lost the
+// subscription, e.g. when appmgr has restarted. The notifications sent meanwhile are
+// lost, so the xApp configurations are then fetched again.
+func (v *VespaMgr) CheckSubscription() {
+	settings := v.settings()
+	subsUrl := fmt.Sprintf("%s%s", settings.appmgrHost, settings.appmgrSubsUrl)
+
+	if v.isSubscribing() {
+		return
+	}
+	if id := v.getSubscriptionId(); id != "" {
+		exists, err := v.SubscriptionExists(subsUrl, id)
+		if err != nil {
+			app.Logger.Warn("Unable to check subscription %s: %v", id, err)
+			return
+		}
+		if exists {
+			return
+		}
+		app.Logger.Warn("Subscription %s no longer known by appmgr", id)
+	}
+
+	v.SubscribeXappNotif(subsUrl)
+}
+
+// MonitorSubscription checks the subscription periodically
+func (v *VespaMgr) MonitorSubscription(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			v.CheckSubscription()
+		case <-v.ctx.Done():
+			return
+		}
+	}
+}
+
+// Shutdown cancels the pending appmgr requests, deletes the xApp notification
+// subscription and stops the VES agent, letting it flush its buffered data
+func (v *VespaMgr) Shutdown() {
+	v.cancel()
+
+	settings := v.settings()
+	if id := v.getSubscriptionId(); id != "" {
+		v.DoUnsubscribe(fmt.Sprintf("%s%s", settings.appmgrHost, settings.appmgrSubsUrl), id)
+	}
+
+	v.agentMu.Lock()
+	defer v.agentMu.Unlock()
+	if result, err := v.vesAgent.Stop(); err == nil {
+		app.Logger.Info("VES agent %s", result)
+	}
+}
+
 func (v *VespaMgr) SubscribeXappNotif(appmgrUrl string) {
-	targetUrl := fmt.Sprintf("%s%s", app.Config.GetString("controls.host"), v.appmgrNotifUrl)
+	if v.subscribeXappNotif(appmgrUrl) {
+		v.UpdateVesagentConfig()
+	}
+}
+
+// subscribeXappNotif returns false without subscribing if another subscription
+// is still in progress
+func (v *VespaMgr) subscribeXappNotif(appmgrUrl string) bool {
+	v.subsMu.Lock()
+	if v.subscribing {
+		v.subsMu.Unlock()
+		app.Logger.Info("Subscription already in progress, skipping")
+		return false
+	}
+	v.subscribing = true
+	v.subsMu.Unlock()
+
+	defer func() {
+		v.subsMu.Lock()
+		v.subscribing = false
+		v.subsMu.Unlock()
+	}()
+
+	settings := v.settings()
+	targetUrl := fmt.Sprintf("%s%s", app.Config.GetString("controls.host"), settings.appmgrNotifUrl)
 	subscriptionData := []byte(fmt.Sprintf(`{"Data": {"maxRetries": 5, "retryTimer": 5, "eventType":"all", "targetUrl": "%v"}}`, targetUrl))
 
-	for i := 0; i < v.appmgrRetry; i++ {
+	err := settings.retryPolicy().Do(v.ctx, "Subscribing xApp notifications", func(ctx context.Context) error {
 		app.Logger.Info("Subscribing xApp notification from: %v", appmgrUrl)
-		if id := v.DoSubscribe(appmgrUrl, subscriptionData); id != "" {
+		id, err := v.doSubscribe(ctx, appmgrUrl, subscriptionData)
+		if err == nil {
 			app.Logger.Info("Subscription done, id=%s", id)
-			break
 		}
-
-		app.Logger.Info("Subscription failed, retyring after short delay ...")
-		time.Sleep(5 * time.Second)
-	}
-
-	if xappConfig, err := v.QueryXappConf(fmt.Sprintf("%s%s", v.appmgrHost, v.appmgrUrl)); err == nil {
-		v.CreateConf(app.Config.GetString("controls.vesagent.configFile"), xappConfig)
-		v.RestartVesagent()
+		return err
+	})
+	if err != nil {
+		app.Logger.Error("Subscription failed: %v", err)
 	}
+	return true
 }
 
 func (v *VespaMgr) respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
@@ -232,30 +825,53 @@ func (v *VespaMgr) respondWithJSON(w http.ResponseWriter, code int, payload inte
 	}
 }
 
-func (v *VespaMgr) StartVesagent() {
-	v.vesAgent = NewCommandRunner("ves-agent", "-i", v.hbInterval, "-m", v.measInterval, "--Debug",
-		"--Measurement.Prometheus.Address", v.prometheusAddr, "--AlertManager.Bind", v.alertManagerBindAddr)
+func (v *VespaMgr) respondWithError(w http.ResponseWriter, code int, err error) {
+	v.respondWithJSON(w, code, map[string]string{"error": err.Error()})
+}
 
-	v.vesAgent.Run(v.chVesagent)
+func (v *VespaMgr) newVesagentRunner() *CommandRunner {
+	settings := v.settings()
+	runner := NewCommandRunner("ves-agent", "-i", settings.hbInterval, "-m", settings.measInterval, "--Debug",
+		"--Measurement.Prometheus.Address", settings.prometheusAddr, "--AlertManager.Bind", settings.alertManagerBindAddr)
+	runner.SetOutput(v.agentLog)
+	return runner
 }
 
-func (v *VespaMgr) RestartVesagent() {
+func (v *VespaMgr) StartVesagent() {
+	v.agentMu.Lock()
+	defer v.agentMu.Unlock()
+	v.vesAgent.Start()
+}
+
+// RestartVesagent stops the running VES agent, if any, and starts it again.
+// It returns how the previous agent process was stopped. Restarts are serialized,
+// so that an agent is never started before the previous one has exited. Nothing
+// is done once the manager has been shut down.
+func (v *VespaMgr) RestartVesagent() (StopResult, error) {
 	if strings.Contains(app.Config.GetString("controls.host"), "localhost") {
-		return
+		return StopNotRunning, nil
 	}
 
-	if v.vesAgent != nil {
-		err := v.vesAgent.Kill()
-		if err != nil {
-			app.Logger.Error("Couldn't kill vespa-agent: %s", err.Error())
-			return
-		}
-		<-v.chVesagent
+	v.agentMu.Lock()
+	defer v.agentMu.Unlock()
+	if v.ctx.Err() != nil {
+		return StopNotRunning, nil
+	}
+
+	result, err := v.vesAgent.Stop()
+	if err != nil {
+		app.Logger.Error("Couldn't stop vespa-agent: %s", err.Error())
+		return result, err
 	}
 
-	v.StartVesagent()
+	v.vesAgent.Start()
+	app.Logger.Info("VES agent restarted, previous agent %s", result)
+	return result, nil
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "render" {
+		os.Exit(Render(os.Args[2:], os.Stdout, os.Stderr))
+	}
 	NewVespaMgr().Run(false, true)
 }
@@ -25,11 +25,15 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -121,7 +125,8 @@ func (suite *VespaMgrTestSuite) TestQueryXAppsConfigOk() {
 	http.HandleFunc("/test_url/", func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "GET":
-			fmt.Fprintf(w, "reply message")
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `[{"metadata": {"xappName": "app1"}}]`)
 		}
 	})
 
@@ -130,7 +135,67 @@ func (suite *VespaMgrTestSuite) TestQueryXAppsConfigOk() {
 	xappConfig, err := suite.vespaMgr.QueryXappConf("http://" + listener.Addr().String() + "/test_url/")
 	suite.NotNil(xappConfig)
 	suite.Nil(err)
-	suite.Equal(xappConfig, []byte("reply message"))
+	suite.Equal(xappConfig, []byte(`[{"metadata": {"xappName": "app1"}}]`))
+}
+
+func (suite *VespaMgrTestSuite) TestQueryXAppsConfigRejectsUnusableResponses() {
+	cases := []struct {
+		code        int
+		contentType string
+		body        string
+	}{
+		{http.StatusInternalServerError, "text/html", "<html>Internal Server Error</html>"},
+		{http.StatusNotFound, "application/json", `{"error": "not found"}`},
+		{http.StatusOK, "text/plain", `[]`},
+		{http.StatusOK, "application/json", `{"error": "not a list"}`},
+		{http.StatusOK, "application/json", ``},
+	}
+
+	for _, c := range cases {
+		testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			res.Header().Set("Content-Type", c.contentType)
+			res.WriteHeader(c.code)
+			res.Write([]byte(c.body))
+		}))
+
+		xappConfig, err := suite.vespaMgr.QueryXappConf(testServer.URL)
+		suite.NotNil(err, c.body)
+		suite.Nil(xappConfig)
+		testServer.Close()
+	}
+}
+
+func (suite *VespaMgrTestSuite) TestUnusableResponseKeepsLastGoodConfig() {
+	data, err := ioutil.ReadFile("../../test/xApp_config_test_output.json")
+	suite.Nil(err)
+
+	failing := int32(0)
+	testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			res.WriteHeader(http.StatusInternalServerError)
+			res.Write([]byte("Internal Server Error"))
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		res.Write(data)
+	}))
+	defer testServer.Close()
+
+	vespaMgr := NewVespaMgr()
+	vespaMgr.appmgrHost = testServer.URL
+	changed, err := vespaMgr.updateVesagentConfig(false)
+	suite.Nil(err)
+	suite.True(changed)
+	applied := vespaMgr.appliedConf
+	rules := len(applied.Measurement.Prometheus.Rules.Metrics)
+	suite.True(rules > 0)
+
+	atomic.StoreInt32(&failing, 1)
+	changed, err = vespaMgr.updateVesagentConfig(false)
+	suite.NotNil(err)
+	suite.False(changed)
+	suite.Equal(applied, vespaMgr.appliedConf)
+	suite.Equal(data, vespaMgr.xappConf)
 }
 
 func (suite *VespaMgrTestSuite) TestHandlexAppNotification() {
@@ -144,6 +209,29 @@ func (suite *VespaMgrTestSuite) TestHandlexAppNotification() {
 	suite.Equal(http.StatusOK, response.Code)
 }
 
+func (suite *VespaMgrTestSuite) TestxAppNotificationsAreCoalesced() {
+	var queries int32
+	testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&queries, 1)
+		res.Header().Add("Content-Type", "application/json")
+		res.Write([]byte(`[]`))
+	}))
+	defer testServer.Close()
+
+	vespaMgr := NewVespaMgr()
+	vespaMgr.appmgrHost = testServer.URL
+	go vespaMgr.CoalesceXappNotifications(200 * time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		req, _ := http.NewRequest("POST", "/ric/v1/xappnotif", bytes.NewBufferString(`{}`))
+		response := executeRequest(req, http.HandlerFunc(vespaMgr.HandlexAppNotification))
+		suite.Equal(http.StatusOK, response.Code)
+	}
+
+	time.Sleep(time.Second)
+	suite.Equal(int32(1), atomic.LoadInt32(&queries))
+}
+
 func (suite *VespaMgrTestSuite) TestSubscribexAppNotificationsOnStartup() {
 	suite.vespaMgr.Run(false, false)
 	time.Sleep(2 * time.Second)
@@ -168,12 +256,79 @@ func (suite *VespaMgrTestSuite) TestCreateConf() {
 	suite.vespaMgr.CreateConf("/unknown/text.txt", []byte{})
 }
 
+func (suite *VespaMgrTestSuite) TestCreateConfSkipsUnchangedConfig() {
+	data, err := ioutil.ReadFile("../../test/xApp_config_test_output.json")
+	suite.Nil(err)
+	fname := fmt.Sprintf("%s/ves-agent-%d.yaml", os.TempDir(), os.Getpid())
+	defer os.Remove(fname)
+
+	vespaMgr := NewVespaMgr()
+	suite.True(vespaMgr.CreateConf(fname, data))
+	info, err := os.Stat(fname)
+	suite.Nil(err)
+	suite.Equal(os.FileMode(0600), info.Mode().Perm())
+	suite.False(vespaMgr.CreateConf(fname, data))
+	suite.True(vespaMgr.CreateConf(fname, []byte{}))
+	os.Remove(fname + ".bak")
+}
+
+func (suite *VespaMgrTestSuite) TestWriteFileAtomic() {
+	dir, err := ioutil.TempDir("", "vespamgr")
+	suite.Nil(err)
+	defer os.RemoveAll(dir)
+	fname := dir + "/ves-agent.yaml"
+
+	write := func(content string) func(io.Writer) error {
+		return func(w io.Writer) error {
+			_, err := io.WriteString(w, content)
+			return err
+		}
+	}
+	suite.Nil(writeFileAtomic(fname, 0644, write("first")))
+	suite.Nil(writeFileAtomic(fname, 0644, write("second")))
+
+	err = writeFileAtomic(fname, 0644, func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return fmt.Errorf("encoding failed")
+	})
+	suite.NotNil(err)
+
+	content, _ := ioutil.ReadFile(fname)
+	suite.Equal("second", string(content))
+	backup, _ := ioutil.ReadFile(fname + ".bak")
+	suite.Equal("first", string(backup))
+	files, _ := ioutil.ReadDir(dir)
+	suite.Len(files, 2)
+}
+
+func (suite *VespaMgrTestSuite) TestWriteFileAtomicBackupPermissions() {
+	dir, err := ioutil.TempDir("", "vespamgr")
+	suite.Nil(err)
+	defer os.RemoveAll(dir)
+	fname := dir + "/ves-agent.yaml"
+
+	// A backup left world-readable by an earlier version gets the new permissions
+	suite.Nil(ioutil.WriteFile(fname+".bak", []byte("old"), 0644))
+	suite.Nil(ioutil.WriteFile(fname, []byte("first"), 0644))
+	suite.Nil(writeFileAtomic(fname, 0600, func(w io.Writer) error {
+		_, err := io.WriteString(w, "second")
+		return err
+	}))
+
+	for _, name := range []string{fname, fname + ".bak"} {
+		info, err := os.Stat(name)
+		suite.Nil(err)
+		suite.Equal(os.FileMode(0600), info.Mode().Perm(), name)
+	}
+	backup, _ := ioutil.ReadFile(fname + ".bak")
+	suite.Equal("first", string(backup))
+}
+
 func (suite *VespaMgrTestSuite) TestHandleMeasurements() {
 	data, err := ioutil.ReadFile("../../test/xApp_config_test_output.json")
 	suite.Nil(err)
 
-	pbodyEn, _ := json.Marshal(data)
-	req, _ := http.NewRequest("POST", "/ric/v1/measurements", bytes.NewBuffer(pbodyEn))
+	req, _ := http.NewRequest("POST", "/ric/v1/measurements", bytes.NewBuffer(data))
 	handleFunc := http.HandlerFunc(suite.vespaMgr.HandleMeasurements)
 	response := executeRequest(req, handleFunc)
 	suite.Equal(http.StatusOK, response.Code)
@@ -185,3 +340,464 @@ func (suite *VespaMgrTestSuite) TestSymptomDataHandler() {
 	resp := executeRequest(req, handleFunc)
 	suite.Equal(http.StatusOK, resp.Code)
 }
+
+func (suite *VespaMgrTestSuite) TestHandleValidationReport() {
+	data, err := ioutil.ReadFile("../../test/inValidMeasurements_xApp_config_test_output.json")
+	suite.Nil(err)
+	vespaMgr := NewVespaMgr()
+	fname := fmt.Sprintf("%s/ves-agent-report-%d.yaml", os.TempDir(), os.Getpid())
+	defer os.Remove(fname)
+	suite.True(vespaMgr.CreateConf(fname, data))
+
+	req, _ := http.NewRequest("GET", "/ric/v1/validation", nil)
+	resp := executeRequest(req, http.HandlerFunc(vespaMgr.HandleValidationReport))
+	suite.Equal(http.StatusOK, resp.Code)
+
+	var report ValidationReport
+	suite.Nil(json.Unmarshal(resp.Body.Bytes(), &report))
+	suite.Len(report.Errors, 10)
+	suite.Equal("moId", report.Errors[0].Field)
+}
+
+func (suite *VespaMgrTestSuite) TestSettingsValidation() {
+	settings := readSettings()
+	suite.Nil(settings.validate())
+
+	invalid := settings
+	invalid.hbInterval = "often"
+	suite.NotNil(invalid.validate())
+
+	invalid = settings
+	invalid.appmgrHost = ""
+	suite.NotNil(invalid.validate())
+
+	changed := settings
+	suite.False(changed.agentArgsChanged(settings))
+	changed.measInterval = "15s"
+	suite.True(changed.agentArgsChanged(settings))
+	suite.False(changed.appmgrChanged(settings))
+	changed.appmgrUrl = "/ric/v2/config"
+	suite.True(changed.appmgrChanged(settings))
+	suite.False(changed.subscriptionChanged(settings))
+	changed.appmgrSubsUrl = "/ric/v2/subscriptions"
+	suite.True(changed.subscriptionChanged(settings))
+}
+
+func (suite *VespaMgrTestSuite) TestApplySettingsResubscribesOnAppmgrChange() {
+	var subscriptions, queries int32
+	testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Add("Content-Type", "application/json")
+		if req.Method == http.MethodPost {
+			atomic.AddInt32(&subscriptions, 1)
+			res.WriteHeader(http.StatusCreated)
+			res.Write([]byte(`{"id": "sub-2"}`))
+			return
+		}
+		atomic.AddInt32(&queries, 1)
+		res.Write([]byte(`[]`))
+	}))
+	defer testServer.Close()
+
+	vespaMgr := NewVespaMgr()
+	settings := vespaMgr.settings()
+	settings.appmgrHost = testServer.URL
+	vespaMgr.ApplySettings(settings)
+
+	suite.Eventually(func() bool { return atomic.LoadInt32(&queries) == 1 }, 5*time.Second, 10*time.Millisecond)
+	suite.Equal(int32(1), atomic.LoadInt32(&subscriptions))
+	suite.Equal(testServer.URL, vespaMgr.settings().appmgrHost)
+}
+
+func (suite *VespaMgrTestSuite) TestApplySettingsDeletesPreviousSubscription() {
+	var deleted atomic.Value
+	deleted.Store("")
+	oldServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodDelete {
+			deleted.Store(req.URL.Path)
+		}
+		res.WriteHeader(http.StatusNoContent)
+	}))
+	defer oldServer.Close()
+	var subscriptions int32
+	newServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Add("Content-Type", "application/json")
+		if req.Method == http.MethodPost {
+			atomic.AddInt32(&subscriptions, 1)
+			res.WriteHeader(http.StatusCreated)
+			res.Write([]byte(`{"id": "sub-2"}`))
+			return
+		}
+		res.Write([]byte(`[]`))
+	}))
+	defer newServer.Close()
+
+	vespaMgr := NewVespaMgr()
+	vespaMgr.appmgrHost = oldServer.URL
+	vespaMgr.subscriptionId = "sub-1"
+	settings := vespaMgr.settings()
+	settings.appmgrHost = newServer.URL
+	vespaMgr.ApplySettings(settings)
+
+	suite.Eventually(func() bool { return vespaMgr.getSubscriptionId() == "sub-2" }, 5*time.Second, 10*time.Millisecond)
+	suite.Equal("/ric/v1/subscriptions/sub-1", deleted.Load())
+	suite.Equal(int32(1), atomic.LoadInt32(&subscriptions))
+}
+
+func (suite *VespaMgrTestSuite) TestApplySettingsRefetchesOnAppmgrPathChange() {
+	var subscriptions, queries int32
+	testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Add("Content-Type", "application/json")
+		if req.Method != http.MethodGet {
+			atomic.AddInt32(&subscriptions, 1)
+			res.WriteHeader(http.StatusCreated)
+			return
+		}
+		atomic.AddInt32(&queries, 1)
+		res.Write([]byte(`[]`))
+	}))
+	defer testServer.Close()
+
+	vespaMgr := NewVespaMgr()
+	vespaMgr.appmgrHost = testServer.URL
+	vespaMgr.subscriptionId = "sub-1"
+	settings := vespaMgr.settings()
+	settings.appmgrUrl = "/ric/v2/config"
+	vespaMgr.ApplySettings(settings)
+
+	suite.Eventually(func() bool { return atomic.LoadInt32(&queries) == 1 }, 5*time.Second, 10*time.Millisecond)
+	suite.Equal(int32(0), atomic.LoadInt32(&subscriptions))
+	suite.Equal("sub-1", vespaMgr.getSubscriptionId())
+}
+
+func (suite *VespaMgrTestSuite) TestConfigChangeWithInvalidCACert() {
+	dir, err := ioutil.TempDir("", "vespamgr")
+	suite.Nil(err)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.crt")
+	suite.Nil(ioutil.WriteFile(caFile, []byte("not a certificate"), 0644))
+
+	vespaMgr := NewVespaMgr()
+	vespaMgr.collectorTLS = CollectorTLS{CaCert: "previous bundle"}
+	settings := vespaMgr.settings()
+	settings.hbInterval = "10s"
+
+	suite.False(vespaMgr.applyConfigChange(settings, caFile))
+	suite.Equal("previous bundle", vespaMgr.getCollectorTLS().CaCert)
+	suite.Nil(vespaMgr.collectorTLSErr)
+	suite.NotEqual("10s", vespaMgr.settings().hbInterval)
+}
+
+func (suite *VespaMgrTestSuite) TestApplySettingsWithoutAppmgrChange() {
+	vespaMgr := NewVespaMgr()
+	vespaMgr.xappConf = []byte(`[]`)
+	settings := vespaMgr.settings()
+	settings.hbInterval = "10s"
+	vespaMgr.ApplySettings(settings)
+
+	suite.Equal("10s", vespaMgr.settings().hbInterval)
+	suite.Contains(vespaMgr.newVesagentRunner().args, "10s")
+	suite.NotNil(vespaMgr.appliedConf)
+}
+
+func (suite *VespaMgrTestSuite) TestApplySettingsBeforeXappConfigsFetched() {
+	vespaMgr := NewVespaMgr()
+	settings := vespaMgr.settings()
+	settings.hbInterval = "10s"
+	vespaMgr.ApplySettings(settings)
+
+	suite.Equal("10s", vespaMgr.settings().hbInterval)
+	suite.Nil(vespaMgr.appliedConf)
+}
+
+func (suite *VespaMgrTestSuite) TestApplySettingsKeepsNotificationUrl() {
+	vespaMgr := NewVespaMgr()
+	vespaMgr.xappConf = []byte(`[]`)
+	settings := vespaMgr.settings()
+	notifUrl := settings.appmgrNotifUrl
+	settings.appmgrNotifUrl = "/ric/v2/xappnotif"
+	settings.measInterval = "15s"
+	vespaMgr.ApplySettings(settings)
+
+	suite.Equal(notifUrl, vespaMgr.settings().appmgrNotifUrl)
+	suite.Equal("15s", vespaMgr.settings().measInterval)
+}
+
+func (suite *VespaMgrTestSuite) TestUnsubscribeOnShutdown() {
+	var deleted string
+	testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodDelete {
+			deleted = req.URL.Path
+		}
+		res.WriteHeader(http.StatusNoContent)
+	}))
+	defer testServer.Close()
+
+	vespaMgr := NewVespaMgr()
+	vespaMgr.appmgrHost = testServer.URL
+	vespaMgr.subscriptionId = "deadbeef"
+	vespaMgr.Shutdown()
+
+	suite.Equal("/ric/v1/subscriptions/deadbeef", deleted)
+	suite.Equal("", vespaMgr.getSubscriptionId())
+}
+
+func (suite *VespaMgrTestSuite) TestBackgroundLoopsStopOnShutdown() {
+	vespaMgr := NewVespaMgr()
+	done := make(chan struct{}, 3)
+	go func() { vespaMgr.MonitorSubscription(time.Hour); done <- struct{}{} }()
+	go func() { vespaMgr.RunReconciler(time.Hour); done <- struct{}{} }()
+	go func() { vespaMgr.CoalesceXappNotifications(time.Hour); done <- struct{}{} }()
+	vespaMgr.chXappNotif <- struct{}{}
+
+	vespaMgr.Shutdown()
+	for i := 0; i < 3; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			suite.Fail("background loop still running after shutdown")
+			return
+		}
+	}
+}
+
+func (suite *VespaMgrTestSuite) TestSubscriptionExists() {
+	testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/subscriptions/known":
+			res.WriteHeader(http.StatusOK)
+		case "/subscriptions/unknown":
+			res.WriteHeader(http.StatusNotFound)
+		default:
+			res.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer testServer.Close()
+
+	vespaMgr := NewVespaMgr()
+	exists, err := vespaMgr.SubscriptionExists(testServer.URL+"/subscriptions", "known")
+	suite.Nil(err)
+	suite.True(exists)
+	exists, err = vespaMgr.SubscriptionExists(testServer.URL+"/subscriptions", "unknown")
+	suite.Nil(err)
+	suite.False(exists)
+	_, err = vespaMgr.SubscriptionExists(testServer.URL+"/subscriptions", "broken")
+	suite.NotNil(err)
+}
+
+func (suite *VespaMgrTestSuite) TestCheckSubscriptionResubscribesLostSubscription() {
+	var subscriptions, queries int32
+	testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Add("Content-Type", "application/json")
+		switch {
+		case req.Method == http.MethodPost:
+			atomic.AddInt32(&subscriptions, 1)
+			res.WriteHeader(http.StatusCreated)
+			res.Write([]byte(`{"id": "new-id"}`))
+		case req.URL.Path == "/ric/v1/subscriptions/new-id":
+			res.WriteHeader(http.StatusOK)
+		case req.URL.Path == "/ric/v1/subscriptions/lost-id":
+			res.WriteHeader(http.StatusNotFound)
+		default:
+			atomic.AddInt32(&queries, 1)
+			res.Write([]byte(`[]`))
+		}
+	}))
+	defer testServer.Close()
+
+	vespaMgr := NewVespaMgr()
+	vespaMgr.appmgrHost = testServer.URL
+	vespaMgr.subscriptionId = "lost-id"
+
+	vespaMgr.CheckSubscription()
+	suite.Equal("new-id", vespaMgr.getSubscriptionId())
+	suite.Equal(int32(1), atomic.LoadInt32(&subscriptions))
+	suite.Equal(int32(1), atomic.LoadInt32(&queries))
+
+	vespaMgr.CheckSubscription()
+	suite.Equal(int32(1), atomic.LoadInt32(&subscriptions))
+	suite.Equal(int32(1), atomic.LoadInt32(&queries))
+}
+
+func (suite *VespaMgrTestSuite) TestCheckSubscriptionSkipsSubscriptionInProgress() {
+	var subscriptions int32
+	posted := make(chan struct{}, 1)
+	release := make(chan struct{})
+	testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		res.Header().Add("Content-Type", "application/json")
+		if req.Method == http.MethodPost {
+			atomic.AddInt32(&subscriptions, 1)
+			posted <- struct{}{}
+			<-release
+			res.WriteHeader(http.StatusCreated)
+			res.Write([]byte(`{"id": "new-id"}`))
+			return
+		}
+		res.Write([]byte(`[]`))
+	}))
+	defer testServer.Close()
+
+	vespaMgr := NewVespaMgr()
+	vespaMgr.appmgrHost = testServer.URL
+
+	done := make(chan struct{})
+	go func() {
+		vespaMgr.SubscribeXappNotif(testServer.URL + vespaMgr.appmgrSubsUrl)
+		close(done)
+	}()
+	<-posted
+
+	vespaMgr.CheckSubscription()
+	suite.Equal(int32(1), atomic.LoadInt32(&subscriptions))
+
+	close(release)
+	<-done
+	suite.Equal("new-id", vespaMgr.getSubscriptionId())
+	suite.Equal(int32(1), atomic.LoadInt32(&subscriptions))
+}
+
+func (suite *VespaMgrTestSuite) TestConfigurationLockIsNotHeldWhileQueryingAppmgr() {
+	queried := make(chan struct{}, 1)
+	release := make(chan struct{})
+	testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		queried <- struct{}{}
+		<-release
+		res.Header().Add("Content-Type", "application/json")
+		res.Write([]byte(`[]`))
+	}))
+	defer testServer.Close()
+
+	vespaMgr := NewVespaMgr()
+	vespaMgr.appmgrHost = testServer.URL
+
+	done := make(chan struct{})
+	go func() {
+		vespaMgr.updateVesagentConfig(false)
+		close(done)
+	}()
+	<-queried
+
+	reconfigured := make(chan struct{})
+	go func() {
+		vespaMgr.reconfigureVesagent(false)
+		close(reconfigured)
+	}()
+	select {
+	case <-reconfigured:
+	case <-time.After(2 * time.Second):
+		suite.Fail("reconfiguring blocked by the appmgr query")
+	}
+
+	close(release)
+	<-done
+	suite.Equal([]byte(`[]`), vespaMgr.xappConf)
+}
+
+func (suite *VespaMgrTestSuite) TestEarlierXappFetchIsDropped() {
+	vespaMgr := NewVespaMgr()
+	suite.True(vespaMgr.acceptXappFetch(2))
+	suite.False(vespaMgr.acceptXappFetch(1))
+	suite.True(vespaMgr.acceptXappFetch(3))
+}
+
+func (suite *VespaMgrTestSuite) TestPayloadIsValidated() {
+	vespaMgr := NewVespaMgr()
+	cases := []struct {
+		contentType string
+		body        string
+		code        int
+	}{
+		{"application/json", `{"id": "1"}`, http.StatusOK},
+		{"application/json; charset=utf-8", `[]`, http.StatusOK},
+		{"", `[]`, http.StatusOK},
+		{"text/plain", `[]`, http.StatusUnsupportedMediaType},
+		{"application/json", `{"id": `, http.StatusBadRequest},
+		{"application/json", `[` + strings.Repeat(" ", 2*1024*1024) + `]`, http.StatusRequestEntityTooLarge},
+	}
+
+	for _, c := range cases {
+		req, _ := http.NewRequest("POST", "/ric/v1/xappnotif", bytes.NewBufferString(c.body))
+		if c.contentType != "" {
+			req.Header.Set("Content-Type", c.contentType)
+		}
+		response := executeRequest(req, http.HandlerFunc(vespaMgr.HandlexAppNotification))
+		suite.Equal(c.code, response.Code, c.contentType)
+
+		if c.code != http.StatusOK {
+			var body map[string]string
+			suite.Nil(json.Unmarshal(response.Body.Bytes(), &body))
+			suite.NotEmpty(body["error"])
+		}
+	}
+}
+
+func (suite *VespaMgrTestSuite) TestPayloadSizeLimit() {
+	vespaMgr := NewVespaMgr()
+	maxSize := app.Config.GetInt("controls.maxPayloadSize")
+	cases := []struct {
+		body io.Reader
+		code int
+	}{
+		{strings.NewReader(`[` + strings.Repeat(" ", maxSize-2) + `]`), http.StatusOK},
+		{strings.NewReader(`[` + strings.Repeat(" ", maxSize-1) + `]`), http.StatusRequestEntityTooLarge},
+		// A broken connection is not reported as a too large payload
+		{io.MultiReader(strings.NewReader(strings.Repeat(" ", maxSize)), failingReader{}), http.StatusBadRequest},
+	}
+
+	for i, c := range cases {
+		req, _ := http.NewRequest("POST", "/ric/v1/xappnotif", c.body)
+		req.Header.Set("Content-Type", "application/json")
+		response := executeRequest(req, http.HandlerFunc(vespaMgr.HandlexAppNotification))
+		suite.Equal(c.code, response.Code, i)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, fmt.Errorf("connection reset")
+}
+
+func (suite *VespaMgrTestSuite) TestPltMeasurementsAreReloaded() {
+	fname := app.Config.GetString("controls.pltFile")
+	defer os.Remove(fname)
+	defer os.Remove(fname + ".bak")
+
+	suite.Nil(storePltMeasurements(fname, []byte(`[]`)))
+	vespaMgr := NewVespaMgr()
+	vespaMgr.LoadPltMeasurements()
+	suite.True(vespaMgr.pltFileCreated)
+
+	suite.Nil(storePltMeasurements(fname, []byte(`[{"broken"`)))
+	vespaMgr = NewVespaMgr()
+	vespaMgr.LoadPltMeasurements()
+	suite.False(vespaMgr.pltFileCreated)
+
+	os.Remove(fname)
+	vespaMgr.LoadPltMeasurements()
+	suite.False(vespaMgr.pltFileCreated)
+}
+
+func (suite *VespaMgrTestSuite) TestPostedPltMeasurementsAreApplied() {
+	data, err := ioutil.ReadFile("../../test/xApp_config_test_output.json")
+	suite.Nil(err)
+	fname := app.Config.GetString("controls.pltFile")
+	defer os.Remove(fname)
+	defer os.Remove(fname + ".bak")
+
+	vespaMgr := NewVespaMgr()
+	vespaMgr.xappConf = []byte(`[]`)
+	req, _ := http.NewRequest("POST", "/ric/v1/measurements", bytes.NewBuffer(data))
+	req.Header.Set("Content-Type", "application/json")
+	response := executeRequest(req, http.HandlerFunc(vespaMgr.HandleMeasurements))
+	suite.Equal(http.StatusOK, response.Code)
+
+	store, err := readPltStore(fname)
+	suite.Nil(err)
+	suite.JSONEq(string(data), string(store[defaultPltComponent]))
+
+	suite.Eventually(func() bool {
+		vespaMgr.confMu.Lock()
+		defer vespaMgr.confMu.Unlock()
+		return vespaMgr.appliedConf != nil && len(vespaMgr.appliedConf.Measurement.Prometheus.Rules.Metrics) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,194 @@
+/*
+ *  Copyright (c) 2020 AT&T Intellectual Property.
+ *  Copyright (c) 2020 Nokia.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  This source code is part of the near-RT RIC (RAN Intelligent Controller)
+ *  platform project (RICP).
+ *
+ */
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	app "gerrit.o-ran-sc.org/r/ric-plt/xapp-frame/pkg/xapp"
+)
+
+// xApp event types sent by appmgr, grouped by their effect on the VES agent configuration
+var (
+	xappAddedEvents   = map[string]bool{"deployed": true, "created": true, "modified": true, "updated": true, "restarted": true}
+	xappRemovedEvents = map[string]bool{"undeployed": true, "deleted": true}
+)
+
+// ParseXappNotification decodes an xApp event notification sent by appmgr. An error
+// is returned if the notification does not tell which xApps changed, and how.
+func ParseXappNotification(payload []byte) (*XappNotification, error) {
+	var n XappNotification
+	if err := json.Unmarshal(payload, &n); err != nil {
+		return nil, err
+	}
+	if !xappAddedEvents[n.EventType] && !xappRemovedEvents[n.EventType] {
+		return nil, fmt.Errorf("unknown event type '%s'", n.EventType)
+	}
+	if len(n.XApps) == 0 {
+		return nil, fmt.Errorf("no xApps in the notification")
+	}
+	for _, x := range n.XApps {
+		if x.Name == "" {
+			return nil, fmt.Errorf("xApp name missing")
+		}
+	}
+	return &n, nil
+}
+
+func (n *XappNotification) String() string {
+	var names []string
+	for _, x := range n.XApps {
+		names = append(names, fmt.Sprintf("%s(%d instances)", x.Name, len(x.Instances)))
+	}
+	return fmt.Sprintf("%s %v", n.EventType, names)
+}
+
+// splitXappConfigs splits the xApp configuration list returned by appmgr into the
+// configurations of each xApp, keyed by the xApp instance. Entries without a name,
+// or of the same instance, are told apart by a hash of their content, so that the
+// key of an entry does not depend on its position in the list.
+func splitXappConfigs(data []byte) (map[string]json.RawMessage, error) {
+	var list []json.RawMessage
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]json.RawMessage)
+	for _, entry := range list {
+		key := xappEntryMetadata(entry).Instance()
+		if _, found := entries[key]; found || key == "" {
+			key = fmt.Sprintf("%s#%x", key, sha256.Sum256(entry))
+		}
+		entries[key] = entry
+	}
+	return entries, nil
+}
+
+func xappEntryMetadata(entry json.RawMessage) XappMetadata {
+	var config struct {
+		Metadata XappMetadata `json:"metadata"`
+	}
+	json.Unmarshal(entry, &config)
+	return config.Metadata
+}
+
+// joinXappConfigs is the reverse of splitXappConfigs. The xApps are ordered by name.
+func joinXappConfigs(entries map[string]json.RawMessage) []byte {
+	var names []string
+	for name := range entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b bytes.Buffer
+	b.WriteString("[")
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.Write(entries[name])
+	}
+	b.WriteString("]")
+	return b.Bytes()
+}
+
+// queueXappNotification stores the notification until the notifications stop arriving.
+// A nil notification asks for a full resync with appmgr.
+func (v *VespaMgr) queueXappNotification(n *XappNotification) {
+	v.notifMu.Lock()
+	v.pendingNotifs = append(v.pendingNotifs, n)
+	v.notifMu.Unlock()
+
+	select {
+	case v.chXappNotif <- struct{}{}:
+	default:
+		// An update is already pending and will cover this notification too
+	}
+}
+
+func (v *VespaMgr) takeXappNotifications() []*XappNotification {
+	v.notifMu.Lock()
+	defer v.notifMu.Unlock()
+
+	notifs := v.pendingNotifs
+	v.pendingNotifs = nil
+	return notifs
+}
+
+// ApplyXappNotifications updates the VES agent configuration with the changes told
+// by the notifications. The rules of removed xApps are dropped without asking
+// appmgr. As appmgr returns the configurations of all xApps, a full resync is done
+// if an xApp was added or modified, or if a notification was unusable. It returns
+// true if the configuration changed.
+func (v *VespaMgr) ApplyXappNotifications(notifs []*XappNotification) (bool, error) {
+	removed := make(map[string]bool)
+	incremental := len(notifs) > 0
+	for _, n := range notifs {
+		if n == nil || !xappRemovedEvents[n.EventType] {
+			incremental = false
+			break
+		}
+		for _, x := range n.XApps {
+			removed[x.Name] = true
+		}
+	}
+
+	if incremental {
+		if changed, ok := v.removeXappConfigs(removed); ok {
+			return changed, nil
+		}
+	}
+	app.Logger.Info("Doing full resync of xApp configurations with appmgr")
+	return v.updateVesagentConfig(false)
+}
+
+// removeXappConfigs drops the configurations of the removed xApps from the ones
+// fetched earlier. It returns false in ok if nothing was fetched yet.
+func (v *VespaMgr) removeXappConfigs(removed map[string]bool) (changed bool, ok bool) {
+	v.confMu.Lock()
+	defer v.confMu.Unlock()
+
+	if v.xappEntries == nil {
+		return false, false
+	}
+	entries := make(map[string]json.RawMessage)
+	for key, entry := range v.xappEntries {
+		if !removed[xappEntryMetadata(entry).XappName] {
+			entries[key] = entry
+		}
+	}
+
+	// A full fetch started before the removal may still contain the removed xApps
+	v.xappFetches++
+	v.xappFetchApplied = v.xappFetches
+	v.xappEntries = entries
+	v.xappConf = joinXappConfigs(entries)
+	changed = v.CreateConf(app.Config.GetString("controls.vesagent.configFile"), v.xappConf)
+	if changed {
+		v.RestartVesagent()
+	}
+	return changed, true
+}
@@ -0,0 +1,170 @@
+/*
+ *  Copyright (c) 2020 AT&T Intellectual Property.
+ *  Copyright (c) 2020 Nokia.
+ *
+ *  Licensed under the Apache License, Version 2.0 (the "License");
+ *  you may not use this file except in compliance with the License.
+ *  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ *  Unless required by applicable law or agreed to in writing, software
+ *  distributed under the License is distributed on an "AS IS" BASIS,
+ *  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ *  See the License for the specific language governing permissions and
+ *  limitations under the License.
+ *
+ *  This source code is part of the near-RT RIC (RAN Intelligent Controller)
+ *  platform project (RICP).
+ *
+ */
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func xappConfigEntry(xapp, counter string) string {
+	return fmt.Sprintf(`{"metadata": {"xappName": "%s"}, "config": {"measurements": [{"moId": "SEP/%s", "measType": "X2", "measId": "1", "measInterval": "60", "metrics": [
+		{"name": "%s", "objectName": "obj", "objectInstance": "inst", "counterId": "1"}]}]}}`, xapp, xapp, counter)
+}
+
+func ruleExprs(v *VespaMgr) []string {
+	var exprs []string
+	for _, rule := range v.appliedConf.Measurement.Prometheus.Rules.Metrics {
+		exprs = append(exprs, rule.Expr)
+	}
+	return exprs
+}
+
+func TestParseXappNotification(t *testing.T) {
+	n, err := ParseXappNotification([]byte(`{"id": "1", "version": 0, "eventType": "deployed",
+		"xApps": [{"name": "app1", "status": "deployed", "instances": [{"name": "app1-0", "ip": "10.0.0.1", "port": 8080}]}]}`))
+	assert.Nil(t, err)
+	assert.Equal(t, "deployed", n.EventType)
+	assert.Equal(t, "app1", n.XApps[0].Name)
+	assert.Equal(t, 1, len(n.XApps[0].Instances))
+
+	for _, payload := range []string{
+		`not json`,
+		`{}`,
+		`{"eventType": "exploded", "xApps": [{"name": "app1"}]}`,
+		`{"eventType": "deployed", "xApps": []}`,
+		`{"eventType": "undeployed", "xApps": [{"status": "undeployed"}]}`,
+	} {
+		_, err := ParseXappNotification([]byte(payload))
+		assert.NotNil(t, err, payload)
+	}
+}
+
+func TestSplitAndJoinXappConfigs(t *testing.T) {
+	entries, err := splitXappConfigs([]byte(`[` + xappConfigEntry("b", "x") + `,` + xappConfigEntry("a", "y") + `, {}]`))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(entries))
+	assert.Contains(t, entries, "a")
+	assert.Contains(t, entries, "b")
+
+	// The keys do not depend on the order of the entries
+	reordered, err := splitXappConfigs([]byte(`[{}, ` + xappConfigEntry("a", "y") + `,` + xappConfigEntry("b", "x") + `]`))
+	assert.Nil(t, err)
+	assert.Equal(t, entries, reordered)
+
+	joined, err := splitXappConfigs(joinXappConfigs(entries))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(joined))
+	assert.Equal(t, entries["a"], joined["a"])
+	assert.Equal(t, entries["b"], joined["b"])
+
+	_, err = splitXappConfigs([]byte(`{}`))
+	assert.NotNil(t, err)
+}
+
+func TestSplitXappConfigsByInstance(t *testing.T) {
+	entries, err := splitXappConfigs([]byte(`[
+		{"metadata": {"xappName": "app", "namespace": "ns1"}},
+		{"metadata": {"xappName": "app", "namespace": "ns2"}},
+		{"metadata": {"xappName": "app", "namespace": "ns2"}, "config": {}}]`))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(entries))
+	assert.Contains(t, entries, "ns1/app")
+	assert.Contains(t, entries, "ns2/app")
+}
+
+func TestApplyXappNotificationsIncrementally(t *testing.T) {
+	var queries int32
+	var served atomic.Value
+	served.Store(`[` + xappConfigEntry("app1", "c1") + `,` + xappConfigEntry("app2", "c2") + `]`)
+	testServer := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&queries, 1)
+		res.Header().Add("Content-Type", "application/json")
+		res.Write([]byte(served.Load().(string)))
+	}))
+	defer testServer.Close()
+
+	vespaMgr := NewVespaMgr()
+	vespaMgr.appmgrHost = testServer.URL
+
+	// Without earlier configurations, a full resync is done
+	changed, err := vespaMgr.ApplyXappNotifications([]*XappNotification{{EventType: "deployed", XApps: []NotifiedXapp{{Name: "app1"}}}})
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queries))
+	assert.Equal(t, 2, len(ruleExprs(vespaMgr)))
+
+	// Removing an xApp does not need appmgr
+	changed, err = vespaMgr.ApplyXappNotifications([]*XappNotification{{EventType: "undeployed", XApps: []NotifiedXapp{{Name: "app2"}}}})
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&queries))
+	assert.Equal(t, 1, len(ruleExprs(vespaMgr)))
+	assert.Contains(t, ruleExprs(vespaMgr)[0], "c1")
+
+	// Adding an xApp takes the configurations of all xApps from appmgr
+	served.Store(`[` + xappConfigEntry("app1", "c1") + `,` + xappConfigEntry("app3", "c3") + `]`)
+	changed, err = vespaMgr.ApplyXappNotifications([]*XappNotification{{EventType: "deployed", XApps: []NotifiedXapp{{Name: "app3"}}}})
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&queries))
+	exprs := ruleExprs(vespaMgr)
+	assert.Equal(t, 2, len(exprs))
+	assert.NotContains(t, fmt.Sprint(exprs), "c2")
+
+	// An unusable notification causes a full resync
+	served.Store(`[` + xappConfigEntry("app1", "c1") + `,` + xappConfigEntry("app2", "c2") + `,` + xappConfigEntry("app3", "c3") + `]`)
+	changed, err = vespaMgr.ApplyXappNotifications([]*XappNotification{nil})
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&queries))
+	assert.Equal(t, 3, len(ruleExprs(vespaMgr)))
+}
+
+func TestRemovalDropsEarlierFetch(t *testing.T) {
+	vespaMgr := NewVespaMgr()
+	vespaMgr.xappEntries = map[string]json.RawMessage{}
+
+	// A fetch started before the removal is not applied after it
+	vespaMgr.xappFetches++
+	seq := vespaMgr.xappFetches
+	_, ok := vespaMgr.removeXappConfigs(map[string]bool{"app1": true})
+	assert.True(t, ok)
+	assert.False(t, vespaMgr.acceptXappFetch(seq))
+	assert.True(t, vespaMgr.acceptXappFetch(seq+2))
+}
+
+func TestNotificationsAreQueuedInOrder(t *testing.T) {
+	vespaMgr := NewVespaMgr()
+	first := &XappNotification{EventType: "deployed", XApps: []NotifiedXapp{{Name: "app1"}}}
+	vespaMgr.queueXappNotification(first)
+	vespaMgr.queueXappNotification(nil)
+
+	assert.Equal(t, []*XappNotification{first, nil}, vespaMgr.takeXappNotifications())
+	assert.Nil(t, vespaMgr.takeXappNotifications())
+	assert.Equal(t, 1, len(vespaMgr.chXappNotif))
+}
@@ -10,6 +10,7 @@ replace gerrit.o-ran-sc.org/r/com/golog => gerrit.o-ran-sc.org/r/com/golog.git v
 
 require (
 	gerrit.o-ran-sc.org/r/ric-plt/xapp-frame v0.0.0-00010101000000-000000000000
+	github.com/gorilla/mux v1.7.1
 	github.com/stretchr/testify v1.5.1
 	gopkg.in/yaml.v2 v2.3.0
 )